@@ -0,0 +1,293 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/influxdata/influxdb1-client/models"
+	"github.com/influxdata/influxql"
+)
+
+// partial aggregates computed on each backend for an aggregate function, first and last are not supported
+// since a grouped partial only carries the time of the bucket but not the time of the point
+var aggregatePartials = map[string][]string{
+	"mean":  {"sum", "count"},
+	"sum":   {"sum"},
+	"count": {"count"},
+	"min":   {"min"},
+	"max":   {"max"},
+}
+
+type aggregateField struct {
+	name    string
+	columns []string
+}
+
+type Aggregator struct {
+	*MergeOptions
+	fields    []*aggregateField
+	columns   []string
+	fill      influxql.FillOption
+	fillValue interface{}
+}
+
+type aggregateBucket struct {
+	time   interface{}
+	values [][][]interface{}
+}
+
+type aggregateSerie struct {
+	row     *models.Row
+	buckets map[int64]*aggregateBucket
+}
+
+// RewriteSelectForAggregate rewrites the aggregate fields into partial aggregates computed on each backend,
+// which are combined by the aggregator in the proxy, e.g. mean is computed by sum and count
+func RewriteSelectForAggregate(stmt *influxql.SelectStatement) (*influxql.SelectStatement, *Aggregator, error) {
+	rstmt, opts := RewriteSelectForMerge(stmt)
+	agg := &Aggregator{
+		MergeOptions: opts,
+		columns:      stmt.ColumnNames(),
+		fill:         stmt.Fill,
+		fillValue:    stmt.FillValue,
+	}
+	fields := make(influxql.Fields, 0, len(stmt.Fields))
+	for i, f := range stmt.Fields {
+		call, ok := f.Expr.(*influxql.Call)
+		if !ok || len(call.Args) != 1 {
+			return nil, nil, ErrMergeAggregate
+		}
+		partials, ok := aggregatePartials[call.Name]
+		if !ok {
+			return nil, nil, ErrMergeAggregate
+		}
+		if _, ok := call.Args[0].(*influxql.VarRef); !ok {
+			return nil, nil, ErrMergeAggregate
+		}
+		af := &aggregateField{name: call.Name}
+		for _, partial := range partials {
+			alias := fmt.Sprintf("__%s_%d", partial, i)
+			fields = append(fields, &influxql.Field{Expr: &influxql.Call{Name: partial, Args: call.Args}, Alias: alias})
+			af.columns = append(af.columns, alias)
+		}
+		agg.fields = append(agg.fields, af)
+	}
+	rstmt.Fields = fields
+	// the buckets of fill(none) differ on each backend, so the limit is only applied after the partials are combined
+	rstmt.Limit = 0
+	if rstmt.Fill != influxql.NoFill {
+		// fill is applied after the partials are combined
+		rstmt.Fill = influxql.NullFill
+		rstmt.FillValue = nil
+	}
+	return rstmt, agg, nil
+}
+
+// Combine combines the partial aggregates of all bodies by series and time
+func (agg *Aggregator) Combine(bodies [][]byte) (rsp *Response, err error) {
+	var keys []string
+	seriesMap := make(map[string]*aggregateSerie)
+	for _, b := range bodies {
+		results, err := ResultsFromResponseBytes(b)
+		if err != nil {
+			return nil, err
+		}
+		if len(results) == 0 {
+			continue
+		}
+		if results[0].Err != "" {
+			return nil, errors.New(results[0].Err)
+		}
+		for _, serie := range results[0].Series {
+			key := seriesKey(serie)
+			as, ok := seriesMap[key]
+			if !ok {
+				as = &aggregateSerie{
+					row:     &models.Row{Name: serie.Name, Tags: serie.Tags, Columns: agg.columns},
+					buckets: make(map[int64]*aggregateBucket),
+				}
+				seriesMap[key] = as
+				keys = append(keys, key)
+			}
+			index := make(map[string]int, len(serie.Columns))
+			for i, c := range serie.Columns {
+				index[c] = i
+			}
+			for _, value := range serie.Values {
+				t := timeOf(value[0])
+				bucket, ok := as.buckets[t]
+				if !ok {
+					bucket = &aggregateBucket{time: value[0], values: make([][][]interface{}, len(agg.fields))}
+					for i, af := range agg.fields {
+						bucket.values[i] = make([][]interface{}, len(af.columns))
+					}
+					as.buckets[t] = bucket
+				}
+				for i, af := range agg.fields {
+					for j, c := range af.columns {
+						if k, ok := index[c]; ok {
+							bucket.values[i][j] = append(bucket.values[i][j], value[k])
+						}
+					}
+				}
+			}
+		}
+	}
+
+	sort.Strings(keys)
+	series := make(models.Rows, 0, len(keys))
+	for _, key := range keys {
+		as := seriesMap[key]
+		times := make([]int64, 0, len(as.buckets))
+		for t := range as.buckets {
+			times = append(times, t)
+		}
+		sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+		values := make([][]interface{}, 0, len(times))
+		for _, t := range times {
+			bucket := as.buckets[t]
+			value := make([]interface{}, 0, len(agg.fields)+1)
+			value = append(value, bucket.time)
+			for i, af := range agg.fields {
+				value = append(value, combinePartials(af.name, bucket.values[i]))
+			}
+			values = append(values, value)
+		}
+		agg.applyFill(values)
+		if agg.Desc {
+			for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+				values[i], values[j] = values[j], values[i]
+			}
+		}
+		as.row.Values = values
+		series = append(series, as.row)
+	}
+	return ResponseFromSeries(series), nil
+}
+
+func (agg *Aggregator) applyFill(values [][]interface{}) {
+	switch agg.fill {
+	case influxql.NumberFill:
+		for _, value := range values {
+			for i := 1; i < len(value); i++ {
+				if value[i] == nil {
+					value[i] = agg.fillValue
+				}
+			}
+		}
+	case influxql.PreviousFill:
+		for k := 1; k < len(values); k++ {
+			for i := 1; i < len(values[k]); i++ {
+				if values[k][i] == nil {
+					values[k][i] = values[k-1][i]
+				}
+			}
+		}
+	case influxql.LinearFill:
+		for i := 1; i < len(agg.fields)+1; i++ {
+			prev := -1
+			for k := 0; k < len(values); k++ {
+				if values[k][i] == nil {
+					continue
+				}
+				if prev >= 0 && k-prev > 1 {
+					start, _ := toFloat(values[prev][i])
+					end, _ := toFloat(values[k][i])
+					for m := prev + 1; m < k; m++ {
+						values[m][i] = start + (end-start)*float64(m-prev)/float64(k-prev)
+					}
+				}
+				prev = k
+			}
+		}
+	}
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case float64:
+		return n, true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func isInteger(v interface{}) bool {
+	switch n := v.(type) {
+	case json.Number:
+		return !strings.ContainsAny(n.String(), ".eE")
+	case int64:
+		return true
+	}
+	return false
+}
+
+func sumValues(vs []interface{}) interface{} {
+	var fsum float64
+	var isum int64
+	integer, found := true, false
+	for _, v := range vs {
+		f, ok := toFloat(v)
+		if !ok {
+			continue
+		}
+		found = true
+		fsum += f
+		if integer && isInteger(v) {
+			n, _ := v.(json.Number).Int64()
+			isum += n
+		} else {
+			integer = false
+		}
+	}
+	switch {
+	case !found:
+		return nil
+	case integer:
+		return isum
+	default:
+		return fsum
+	}
+}
+
+func selectValue(vs []interface{}, less func(a, b float64) bool) interface{} {
+	var selected interface{}
+	var sf float64
+	for _, v := range vs {
+		f, ok := toFloat(v)
+		if !ok {
+			continue
+		}
+		if selected == nil || less(f, sf) {
+			selected, sf = v, f
+		}
+	}
+	return selected
+}
+
+// combinePartials combines the partials of all backends
+func combinePartials(name string, partials [][]interface{}) interface{} {
+	switch name {
+	case "sum", "count":
+		return sumValues(partials[0])
+	case "mean":
+		sum, _ := toFloat(sumValues(partials[0]))
+		count, _ := toFloat(sumValues(partials[1]))
+		if count == 0 {
+			return nil
+		}
+		return sum / count
+	case "min":
+		return selectValue(partials[0], func(a, b float64) bool { return a < b })
+	case "max":
+		return selectValue(partials[0], func(a, b float64) bool { return a > b })
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package backend
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRewriteSelectForAggregate(t *testing.T) {
+	tests := []struct {
+		q    string
+		want string
+		err  error
+	}{
+		{
+			q:    "select mean(value), max(value) from cpu where time > 0 group by time(1m), host fill(0)",
+			want: "SELECT sum(value) AS __sum_0, count(value) AS __count_0, max(value) AS __max_1 FROM cpu WHERE time > 0 GROUP BY time(1m), host",
+		},
+		{
+			q:    "select count(value) as n from cpu where time > 0 group by time(1m) fill(none)",
+			want: "SELECT count(value) AS __count_0 FROM cpu WHERE time > 0 GROUP BY time(1m) fill(none)",
+		},
+		{
+			q:    "select sum(value) from cpu where time > 0 group by time(1m) fill(none) limit 2 offset 1",
+			want: "SELECT sum(value) AS __sum_0 FROM cpu WHERE time > 0 GROUP BY time(1m) fill(none)",
+		},
+		{
+			q:   "select percentile(value, 90) from cpu group by time(1m)",
+			err: ErrMergeAggregate,
+		},
+		{
+			q:   "select mean(value) + 1 from cpu group by time(1m)",
+			err: ErrMergeAggregate,
+		},
+		{
+			q:   "select first(value) from cpu group by time(1m)",
+			err: ErrMergeAggregate,
+		},
+		{
+			q:   "select mean(value), last(value) from cpu group by time(1m)",
+			err: ErrMergeAggregate,
+		},
+	}
+	for _, tt := range tests {
+		stmt, err := ParseSelectStatement(tt.q, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rstmt, _, err := RewriteSelectForAggregate(stmt)
+		if err != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.q, err, tt.err)
+			continue
+		}
+		if err == nil && rstmt.String() != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.q, rstmt, tt.want)
+		}
+	}
+}
+
+func TestAggregatorCombine(t *testing.T) {
+	bodies := [][]byte{
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","__sum_0","__count_0","__sum_1","__min_2","__max_3"],"values":[[0,10,2,10,4,4],[60,null,null,null,null,null],[120,6,1,6,6,6]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","__sum_0","__count_0","__sum_1","__min_2","__max_3"],"values":[[0,2.5,1,2.5,2.5,2.5],[60,null,null,null,null,null],[120,null,null,null,null,null]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0}]}`),
+	}
+	tests := []struct {
+		q    string
+		want string
+	}{
+		{
+			q:    "select mean(value), sum(value), min(value), max(value) from cpu where time >= 0 and time < 180s group by time(1m)",
+			want: `[[0,4.166666666666667,12.5,2.5,4],[60,null,null,null,null],[120,6,6,6,6]]`,
+		},
+		{
+			q:    "select mean(value), sum(value), min(value), max(value) from cpu where time >= 0 and time < 180s group by time(1m) fill(previous)",
+			want: `[[0,4.166666666666667,12.5,2.5,4],[60,4.166666666666667,12.5,2.5,4],[120,6,6,6,6]]`,
+		},
+		{
+			q:    "select mean(value), sum(value), min(value), max(value) from cpu where time >= 0 and time < 180s group by time(1m) fill(linear) order by time desc limit 2",
+			want: `[[120,6,6,6,6],[60,5.083333333333334,9.25,4.25,5]]`,
+		},
+	}
+	for _, tt := range tests {
+		stmt, err := ParseSelectStatement(tt.q, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, agg, err := RewriteSelectForAggregate(stmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp, err := agg.Combine(bodies)
+		if err != nil {
+			t.Fatal(err)
+		}
+		agg.Apply(rsp)
+		serie := rsp.Results[0].Series[0]
+		got, _ := json.Marshal(serie.Values)
+		if string(got) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.q, got, tt.want)
+		}
+		columns, _ := json.Marshal(serie.Columns)
+		if string(columns) != `["time","mean","sum","min","max"]` {
+			t.Errorf("%s: got columns %s", tt.q, columns)
+		}
+	}
+}
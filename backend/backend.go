@@ -2,51 +2,113 @@ package backend
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"log"
 	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/panjf2000/ants/v2"
 )
 
+var (
+	ErrBackendClosed  = errors.New("backend closed")
+	errRewriteAborted = errors.New("rewrite aborted")
+)
+
 type CacheBuffer struct {
+	Db      string
+	Rp      string
 	Buffer  *bytes.Buffer
 	Counter int
+	Acks    []*WriteAck
+	Segment *walSegment
 }
 
 type Backend struct {
 	*HttpBackend
 	fb   *FileBackend
+	wal  *WriteAheadLog
 	pool *ants.Pool
 
-	flushSize       int
-	flushTime       int
-	rewriteInterval int
-	rewriteTicker   *time.Ticker
-	chWrite         chan *LinePoint
-	chTimer         <-chan time.Time
-	buffers         map[string]*CacheBuffer
-	wg              sync.WaitGroup
+	flushSize          int
+	flushTime          int
+	rewriteInterval    atomic.Value
+	rewriteConcurrency atomic.Value
+	bytesLimiter       *RateLimiter
+	pointsLimiter      *RateLimiter
+	liveWrites         int32
+	chLiveIdle         chan struct{}
+	rewriteTicker      *time.Ticker
+	chWrite            chan *LinePoint
+	chConfig           chan *ProxyConfig
+	chTimer            <-chan time.Time
+	chClosing          chan struct{}
+	chClosed           chan struct{}
+	closeLock          sync.RWMutex
+	closed             bool
+	chRewrite          chan struct{}
+	chRetry            chan struct{}
+	buffers            map[string]*CacheBuffer
+	wg                 sync.WaitGroup
+	spoolAll           atomic.Value
+	rewritePaused      atomic.Value
+	rewriteLock        sync.Mutex
+	rewriteSamples     [rewriteRateBatches]rewriteSample
+	rewriteNext        int
+}
+
+// the rewrite rate is measured over the last batches, excluding the waits between batches
+const rewriteRateBatches = 16
+
+type rewriteSample struct {
+	bytes   int64
+	elapsed time.Duration
 }
 
 func NewBackend(cfg *BackendConfig, pxcfg *ProxyConfig) (ib *Backend) {
 	ib = &Backend{
-		HttpBackend:     NewHttpBackend(cfg, pxcfg),
-		flushSize:       pxcfg.FlushSize,
-		flushTime:       pxcfg.FlushTime,
-		rewriteInterval: pxcfg.RewriteInterval,
-		rewriteTicker:   time.NewTicker(time.Duration(pxcfg.RewriteInterval) * time.Second),
-		chWrite:         make(chan *LinePoint, 16),
-		buffers:         make(map[string]*CacheBuffer),
+		HttpBackend:   NewHttpBackend(cfg, pxcfg),
+		flushSize:     pxcfg.FlushSize,
+		flushTime:     pxcfg.FlushTime,
+		bytesLimiter:  NewRateLimiter(pxcfg.RewriteRateLimit),
+		pointsLimiter: NewRateLimiter(pxcfg.RewritePointsLimit),
+		rewriteTicker: time.NewTicker(time.Duration(pxcfg.RewriteInterval) * time.Second),
+		chWrite:       make(chan *LinePoint, 16),
+		chConfig:      make(chan *ProxyConfig, 1),
+		chClosing:     make(chan struct{}),
+		chClosed:      make(chan struct{}),
+		chRewrite:     make(chan struct{}, 1),
+		chRetry:       make(chan struct{}, 1),
+		chLiveIdle:    make(chan struct{}, 1),
+		buffers:       make(map[string]*CacheBuffer),
 	}
+	ib.rewriteInterval.Store(pxcfg.RewriteInterval)
+	ib.rewriteConcurrency.Store(pxcfg.RewriteConcurrency)
+	ib.spoolAll.Store(false)
+	ib.rewritePaused.Store(false)
 
 	var err error
-	ib.fb, err = NewFileBackend(cfg.Name, pxcfg.DataDir)
+	ib.fb, err = NewFileBackend(cfg.Name, pxcfg.DataDir, pxcfg)
 	if err != nil {
 		panic(err)
 	}
+	if pxcfg.WALEnabled {
+		ib.wal, err = NewWriteAheadLog(cfg.Name, pxcfg.DataDir)
+		if err != nil {
+			panic(err)
+		}
+		count, err := ib.wal.Replay(ib.spoolRaw)
+		if err != nil {
+			log.Printf("replay wal error: %s %s", cfg.Name, err)
+		}
+		if count > 0 {
+			log.Printf("replay wal: %s, %d segments spooled", cfg.Name, count)
+		}
+	}
 	ib.pool, err = ants.NewPool(pxcfg.ConnPoolSize)
 	if err != nil {
 		panic(err)
@@ -56,6 +118,29 @@ func NewBackend(cfg *BackendConfig, pxcfg *ProxyConfig) (ib *Backend) {
 	return
 }
 
+// dbrpKey encodes db and rp as the key of the buffers, the prefix of the spooled records and the name
+// of the wal segments, the key of version <= 2.5 is the escaped db
+func dbrpKey(db, rp string) string {
+	q := url.Values{}
+	q.Set("db", db)
+	if rp != "" {
+		q.Set("rp", rp)
+	}
+	return q.Encode()
+}
+
+func parseDbrpKey(key string) (db, rp string, err error) {
+	if !strings.Contains(key, "=") {
+		db, err = url.QueryUnescape(key)
+		return
+	}
+	q, err := url.ParseQuery(key)
+	if err != nil {
+		return
+	}
+	return q.Get("db"), q.Get("rp"), nil
+}
+
 func NewSimpleBackend(cfg *BackendConfig) *Backend {
 	return &Backend{HttpBackend: NewSimpleHttpBackend(cfg)}
 }
@@ -65,13 +150,23 @@ func (ib *Backend) worker() {
 		select {
 		case p, ok := <-ib.chWrite:
 			if !ok {
-				// closed
+				// closed, the buffers are flushed and the flushes and rewrites in flight are waited
+				ib.rewriteTicker.Stop()
 				ib.Flush()
 				ib.wg.Wait()
 				ib.HttpBackend.Close()
 				ib.fb.Close()
+				close(ib.chClosed)
 				return
 			}
+			if p.Line == nil {
+				if p.Sync != nil {
+					ib.SyncWal(p)
+				} else {
+					ib.FlushAck(p)
+				}
+				continue
+			}
 			ib.WriteBuffer(p)
 
 		case <-ib.chTimer:
@@ -79,23 +174,84 @@ func (ib *Backend) worker() {
 
 		case <-ib.rewriteTicker.C:
 			ib.RewriteIdle()
+
+		case <-ib.chRewrite:
+			notify(ib.chRetry)
+			ib.RewriteIdle()
+
+		case pxcfg := <-ib.chConfig:
+			ib.reload(pxcfg)
+		}
+	}
+}
+
+// Reload applies the flush, rewrite and http settings of pxcfg to the running backend, it does not block
+// on a busy or closed worker, a config not taken yet by the worker is replaced
+func (ib *Backend) Reload(pxcfg *ProxyConfig) {
+	ib.HttpBackend.Reload(pxcfg)
+	for {
+		select {
+		case ib.chConfig <- pxcfg:
+			return
+		default:
+		}
+		select {
+		case <-ib.chConfig:
+		default:
 		}
 	}
 }
 
+func (ib *Backend) reload(pxcfg *ProxyConfig) {
+	ib.flushSize = pxcfg.FlushSize
+	ib.flushTime = pxcfg.FlushTime
+	if ib.rewriteInterval.Load().(int) != pxcfg.RewriteInterval {
+		ib.rewriteInterval.Store(pxcfg.RewriteInterval)
+		ib.rewriteTicker.Stop()
+		ib.rewriteTicker = time.NewTicker(time.Duration(pxcfg.RewriteInterval) * time.Second)
+	}
+	ib.rewriteConcurrency.Store(pxcfg.RewriteConcurrency)
+	ib.bytesLimiter.SetRate(pxcfg.RewriteRateLimit)
+	ib.pointsLimiter.SetRate(pxcfg.RewritePointsLimit)
+}
+
+func (ib *Backend) getRewriteInterval() time.Duration {
+	return time.Duration(ib.rewriteInterval.Load().(int)) * time.Second
+}
+
+// WritePoint queues the point to the worker, the sync or ack marker of a closed backend is released
+// once the backend is drained, since its buffers are flushed when it is closed
 func (ib *Backend) WritePoint(point *LinePoint) (err error) {
-	ib.chWrite <- point
+	ib.closeLock.RLock()
+	if !ib.closed {
+		ib.chWrite <- point
+		ib.closeLock.RUnlock()
+		return
+	}
+	ib.closeLock.RUnlock()
+	if point.Line != nil {
+		return ErrBackendClosed
+	}
+	<-ib.chClosed
+	if point.Sync != nil {
+		point.Sync.wg.Done()
+	} else {
+		point.Ack.seal(ib)
+	}
 	return
 }
 
 func (ib *Backend) WriteBuffer(point *LinePoint) (err error) {
-	db, line := point.Db, point.Line
-	cb, ok := ib.buffers[db]
+	key, line := dbrpKey(point.Db, point.Rp), point.Line
+	cb, ok := ib.buffers[key]
 	if !ok {
-		ib.buffers[db] = &CacheBuffer{Buffer: &bytes.Buffer{}}
-		cb = ib.buffers[db]
+		cb = &CacheBuffer{Db: point.Db, Rp: point.Rp, Buffer: &bytes.Buffer{}}
+		ib.buffers[key] = cb
 	}
 	cb.Counter++
+	if point.Ack != nil && !containsAck(cb.Acks, point.Ack) {
+		cb.Acks = append(cb.Acks, point.Ack)
+	}
 	if cb.Buffer == nil {
 		cb.Buffer = &bytes.Buffer{}
 	}
@@ -116,163 +272,460 @@ func (ib *Backend) WriteBuffer(point *LinePoint) (err error) {
 			return
 		}
 	}
+	if ib.wal != nil {
+		err = ib.writeWal(key, cb, line)
+		if err != nil && point.Sync != nil {
+			point.Sync.fail()
+		}
+	}
 
 	switch {
 	case cb.Counter >= ib.flushSize:
-		ib.FlushBuffer(db)
+		ib.FlushBuffer(key)
 	case ib.chTimer == nil:
 		ib.chTimer = time.After(time.Duration(ib.flushTime) * time.Second)
 	}
 	return
 }
 
-func (ib *Backend) FlushBuffer(db string) {
-	cb := ib.buffers[db]
-	if cb.Buffer == nil {
+func (ib *Backend) FlushBuffer(key string) {
+	cb := ib.buffers[key]
+	if cb == nil || cb.Buffer == nil {
 		return
 	}
+	db, rp := cb.Db, cb.Rp
 	p := cb.Buffer.Bytes()
+	counter := cb.Counter
+	acks := cb.Acks
+	seg := cb.Segment
 	cb.Buffer = nil
 	cb.Counter = 0
+	cb.Acks = nil
+	cb.Segment = nil
+	if seg != nil {
+		err := seg.Close()
+		if err != nil {
+			log.Printf("close wal segment error: %s", err)
+		}
+	}
 	if len(p) == 0 {
 		return
 	}
 
+	for _, ack := range acks {
+		ack.begin(ib)
+	}
 	ib.wg.Add(1)
+	// the flush is live from being queued on the pool, the rewrite yields to it until done
+	atomic.AddInt32(&ib.liveWrites, 1)
 	ib.pool.Submit(func() {
 		defer ib.wg.Done()
-		var buf bytes.Buffer
-		err := Compress(&buf, p)
+		err := ib.WriteOrSpool(db, rp, p)
+		if atomic.AddInt32(&ib.liveWrites, -1) == 0 {
+			notify(ib.chLiveIdle)
+		}
+		for _, ack := range acks {
+			ack.done(ib, err)
+		}
+		if seg != nil && (err == nil || err == ErrSpooled || err == ErrBadRequest || err == ErrNotFound) {
+			// the points are written, spooled or dropped by the backend, a failed spool keeps the segment for replay
+			seg.Remove()
+		}
+		switch err {
+		case nil:
+			PointsFlushed.WithLabelValues(ib.Name, "written").Add(float64(counter))
+		case ErrSpooled:
+			PointsFlushed.WithLabelValues(ib.Name, "spooled").Add(float64(counter))
+		default:
+			PointsFlushed.WithLabelValues(ib.Name, "dropped").Add(float64(counter))
+		}
+	})
+}
+
+func (ib *Backend) writeWal(key string, cb *CacheBuffer, line []byte) (err error) {
+	if cb.Segment == nil {
+		cb.Segment, err = ib.wal.Create(key)
 		if err != nil {
-			log.Print("compress buffer error: ", err)
+			log.Printf("create wal segment error: %s", err)
 			return
 		}
+	}
+	err = cb.Segment.Write(line)
+	if err != nil {
+		log.Printf("wal write error: %s", err)
+	}
+	return
+}
 
-		p = buf.Bytes()
-
-		if ib.IsActive() {
-			err = ib.WriteCompressed(db, p)
-			switch err {
-			case nil:
-				return
-			case ErrBadRequest:
-				log.Printf("bad request, drop all data")
-				return
-			case ErrNotFound:
-				log.Printf("bad backend, drop all data")
-				return
-			default:
-				log.Printf("write http error: %s %s, length: %d", ib.Url, db, len(p))
-			}
+// SyncWal syncs the wal segment of the buffer holding the points of the write request
+func (ib *Backend) SyncWal(point *LinePoint) {
+	if cb := ib.buffers[dbrpKey(point.Db, point.Rp)]; cb != nil && cb.Segment != nil {
+		err := cb.Segment.Sync()
+		if err != nil {
+			log.Printf("sync wal segment error: %s", err)
+			point.Sync.fail()
 		}
+	}
+	point.Sync.wg.Done()
+}
 
-		b := bytes.Join([][]byte{[]byte(url.QueryEscape(db)), p}, []byte{' '})
-		err = ib.fb.Write(b)
-		if err != nil {
-			log.Printf("write db and data to file error with db: %s, length: %d error: %s", db, len(p), err)
+// FlushAck flushes the buffer holding the points of the write request and seals its ack
+func (ib *Backend) FlushAck(point *LinePoint) {
+	ib.FlushBuffer(dbrpKey(point.Db, point.Rp))
+	point.Ack.seal(ib)
+}
+
+func (ib *Backend) WriteOrSpool(db, rp string, p []byte) (err error) {
+	var buf bytes.Buffer
+	err = Compress(&buf, p)
+	if err != nil {
+		log.Print("compress buffer error: ", err)
+		return
+	}
+
+	p = buf.Bytes()
+
+	if ib.IsActive() && !ib.spoolAll.Load().(bool) {
+		start := time.Now()
+		err = ib.WriteCompressed(db, rp, p)
+		FlushDuration.WithLabelValues(ib.Name).Observe(time.Since(start).Seconds())
+		switch err {
+		case nil:
+			return
+		case ErrBadRequest:
+			log.Printf("bad request, drop all data")
 			return
+		case ErrNotFound:
+			log.Printf("bad backend, drop all data")
+			return
+		default:
+			log.Printf("write http error: %s %s, length: %d", ib.Url, db, len(p))
 		}
-	})
+	}
+
+	err = ib.spool(db, rp, p)
+	if err != nil {
+		return
+	}
+	return ErrSpooled
+}
+
+func (ib *Backend) spool(db, rp string, p []byte) (err error) {
+	b := bytes.Join([][]byte{[]byte(dbrpKey(db, rp)), p}, []byte{' '})
+	err = ib.fb.Write(b)
+	if err != nil {
+		log.Printf("write db and data to file error with db: %s, length: %d error: %s", db, len(p), err)
+	}
+	return
+}
+
+// spoolRaw compresses the points and spools them to the file
+func (ib *Backend) spoolRaw(db, rp string, p []byte) (err error) {
+	var buf bytes.Buffer
+	err = Compress(&buf, p)
+	if err != nil {
+		return
+	}
+	return ib.spool(db, rp, buf.Bytes())
 }
 
 func (ib *Backend) Flush() {
 	ib.chTimer = nil
-	for db := range ib.buffers {
-		if ib.buffers[db].Counter > 0 {
-			ib.FlushBuffer(db)
+	for key := range ib.buffers {
+		if ib.buffers[key].Counter > 0 {
+			ib.FlushBuffer(key)
+		}
+	}
+}
+
+func containsAck(acks []*WriteAck, ack *WriteAck) bool {
+	for i := len(acks) - 1; i >= 0; i-- {
+		if acks[i] == ack {
+			return true
 		}
 	}
+	return false
 }
 
 func (ib *Backend) RewriteIdle() {
-	if !ib.IsRewriting() && ib.fb.IsData() {
+	if !ib.IsRewriting() && !ib.IsRewritePaused() && ib.fb.IsData() {
 		ib.SetRewriting(true)
+		ib.rewriteLock.Lock()
+		ib.rewriteSamples = [rewriteRateBatches]rewriteSample{}
+		ib.rewriteLock.Unlock()
+		ib.wg.Add(1)
 		go ib.RewriteLoop()
 	}
 }
 
 func (ib *Backend) RewriteLoop() {
-	for ib.fb.IsData() {
+	defer ib.wg.Done()
+	for ib.fb.IsData() && !ib.isClosing() && !ib.IsRewritePaused() {
 		if !ib.IsActive() {
-			time.Sleep(time.Duration(ib.rewriteInterval) * time.Second)
+			ib.waitRewrite()
 			continue
 		}
 		err := ib.Rewrite()
 		if err != nil {
-			time.Sleep(time.Duration(ib.rewriteInterval) * time.Second)
+			ib.waitRewrite()
 			continue
 		}
 	}
 	ib.SetRewriting(false)
 }
 
+// waitRewrite waits for the rewrite interval, or returns early when the backend is closing
+func (ib *Backend) waitRewrite() {
+	select {
+	case <-time.After(ib.getRewriteInterval()):
+	case <-ib.chRetry:
+	case <-ib.chClosing:
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// RewriteNow starts the rewrite of the spooled data at once, or retries at once when the rewrite is waiting
+func (ib *Backend) RewriteNow() {
+	notify(ib.chRewrite)
+}
+
+// PauseRewrite stops the rewrite after the data in flight, the spooled data is kept until resumed
+func (ib *Backend) PauseRewrite() {
+	ib.rewritePaused.Store(true)
+	notify(ib.chRetry)
+}
+
+func (ib *Backend) ResumeRewrite() {
+	ib.rewritePaused.Store(false)
+	ib.RewriteNow()
+}
+
+func (ib *Backend) IsRewritePaused() bool {
+	return ib.rewritePaused.Load().(bool)
+}
+
+// PurgeBacklog drops all the spooled data of the backend
+func (ib *Backend) PurgeBacklog() error {
+	return ib.fb.Purge()
+}
+
+func (ib *Backend) isClosing() bool {
+	select {
+	case <-ib.chClosing:
+		return true
+	default:
+		return false
+	}
+}
+
+// Rewrite writes a batch of records from the file in parallel, the records up to the first one failed
+// are consumed, and the others are rewritten in order next time
 func (ib *Backend) Rewrite() (err error) {
-	b, err := ib.fb.Read()
+	records, err := ib.fb.ReadBatch(ib.rewriteConcurrency.Load().(int))
 	if err != nil {
 		log.Print("rewrite read file error: ", err)
 		return
 	}
-	if b == nil {
+	if len(records) == 0 {
 		return
 	}
 
+	start := time.Now()
+	errs := make([]error, len(records))
+	var wg sync.WaitGroup
+	for i, b := range records {
+		wg.Add(1)
+		go func(i int, b []byte) {
+			defer wg.Done()
+			errs[i] = ib.rewriteRecord(b)
+		}(i, b)
+	}
+	wg.Wait()
+	n := 0
+	for n < len(records) && errs[n] == nil {
+		n++
+	}
+	var written int64
+	for _, b := range records[:n] {
+		written += int64(len(b))
+	}
+	RewriteBytes.WithLabelValues(ib.Name).Add(float64(written))
+	ib.rewriteLock.Lock()
+	ib.rewriteSamples[ib.rewriteNext] = rewriteSample{bytes: written, elapsed: time.Since(start)}
+	ib.rewriteNext = (ib.rewriteNext + 1) % rewriteRateBatches
+	ib.rewriteLock.Unlock()
+
+	cerr := ib.fb.CommitBatch(n)
+	if cerr != nil {
+		log.Printf("commit batch error: %s", cerr)
+	}
+	if n < len(records) {
+		RewriteErrors.WithLabelValues(ib.Name).Inc()
+		return errs[n]
+	}
+	return cerr
+}
+
+func (ib *Backend) rewriteRecord(b []byte) (err error) {
 	p := bytes.SplitN(b, []byte{' '}, 2)
 	if len(p) < 2 {
 		log.Print("rewrite read invalid data with length: ", len(p))
 		return
 	}
-	db, err := url.QueryUnescape(string(p[0]))
+	db, rp, err := parseDbrpKey(string(p[0]))
 	if err != nil {
 		log.Print("rewrite db unescape error: ", err)
-		return
+		return nil
+	}
+	if !ib.yieldLiveWrites() || !ib.waitRate(ib.bytesLimiter, len(b)) {
+		return errRewriteAborted
+	}
+	if ib.pointsLimiter.Limited() {
+		lines, err := GzipDecompress(p[1])
+		if err == nil && !ib.waitRate(ib.pointsLimiter, bytes.Count(lines, []byte{'\n'})) {
+			return errRewriteAborted
+		}
 	}
-	err = ib.WriteCompressed(db, p[1])
+	err = ib.WriteCompressed(db, rp, p[1])
 
 	switch err {
 	case nil:
 	case ErrBadRequest:
 		log.Printf("bad request, drop all data")
-		err = nil
+		return nil
 	case ErrNotFound:
 		log.Printf("bad backend, drop all data")
-		err = nil
+		return nil
 	default:
 		log.Printf("rewrite http error: %s %s, length: %d", ib.Url, db, len(p[1]))
-
-		err = ib.fb.RollbackMeta()
-		if err != nil {
-			log.Printf("rollback meta error: %s", err)
-		}
 		return
 	}
 
-	err = ib.fb.UpdateMeta()
-	if err != nil {
-		log.Printf("update meta error: %s", err)
-	}
 	return
 }
 
+// waitRate waits until n tokens of the limiter are available, false if the backend is closing
+func (ib *Backend) waitRate(rl *RateLimiter, n int) bool {
+	d := rl.Reserve(n)
+	if d <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(d):
+		return true
+	case <-ib.chClosing:
+		return false
+	}
+}
+
+// yieldLiveWrites holds a rewrite record while live flushes are queued or in flight, it is woken once
+// they are done and goes on after one second so that the rewrite is not starved by a steady write load,
+// false if the backend is closing
+func (ib *Backend) yieldLiveWrites() bool {
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+	for atomic.LoadInt32(&ib.liveWrites) > 0 {
+		select {
+		case <-ib.chLiveIdle:
+		case <-timer.C:
+			return true
+		case <-ib.chClosing:
+			return false
+		}
+	}
+	return true
+}
+
+// Close flushes the buffers and waits until the points are written or spooled, the pool is
+// released at last since the flushes are submitted to it
 func (ib *Backend) Close() {
-	ib.pool.Release()
+	ib.closeLock.Lock()
+	ib.closed = true
+	close(ib.chClosing)
 	close(ib.chWrite)
+	ib.closeLock.Unlock()
+	<-ib.chClosed
+	ib.pool.Release()
+}
+
+// SpoolAll aborts the writes in flight and spools the points not written yet to the file,
+// used when the backend cannot be drained before the shutdown deadline
+func (ib *Backend) SpoolAll() {
+	ib.spoolAll.Store(true)
+	ib.CancelWrites()
+}
+
+// GetBacklog returns the spool stats with the rewrite rate in bytes per second of the last batches of the running rewrite,
+// and the eta in seconds to rewrite the spool at that rate, -1 if unknown
+func (ib *Backend) GetBacklog() interface{} {
+	backlog := struct {
+		Name    string `json:"name"`
+		Url     string `json:"url"` // nolint:golint
+		Active  bool   `json:"active"`
+		Rewrite bool   `json:"rewrite"`
+		Paused  bool   `json:"paused"`
+		*SpoolStats
+		Rate float64 `json:"rate"`
+		Eta  int64   `json:"eta"`
+	}{
+		Name:       ib.Name,
+		Url:        ib.Url,
+		Active:     ib.IsActive(),
+		Rewrite:    ib.IsRewriting(),
+		Paused:     ib.IsRewritePaused(),
+		SpoolStats: ib.fb.Stats(),
+		Eta:        -1,
+	}
+	if backlog.Rewrite {
+		backlog.Rate = ib.rewriteRate()
+	}
+	if backlog.Bytes == 0 {
+		backlog.Eta = 0
+	} else if backlog.Rate > 0 {
+		backlog.Eta = int64(float64(backlog.Bytes) / backlog.Rate)
+	}
+	return backlog
+}
+
+// rewriteRate returns the bytes per second rewritten in the last batches
+func (ib *Backend) rewriteRate() float64 {
+	ib.rewriteLock.Lock()
+	defer ib.rewriteLock.Unlock()
+	var written int64
+	var elapsed time.Duration
+	for _, sample := range ib.rewriteSamples {
+		written += sample.bytes
+		elapsed += sample.elapsed
+	}
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(written) / elapsed.Seconds()
 }
 
 func (ib *Backend) GetHealth(ic *Circle, withStats bool) interface{} {
 	health := struct {
-		Name    string      `json:"name"`
-		Url     string      `json:"url"` // nolint:golint
-		Active  bool        `json:"active"`
-		Backlog bool        `json:"backlog"`
-		Rewrite bool        `json:"rewrite"`
-		Healthy bool        `json:"healthy,omitempty"`
-		Stats   interface{} `json:"stats,omitempty"`
+		Name    string        `json:"name"`
+		Url     string        `json:"url"` // nolint:golint
+		Active  bool          `json:"active"`
+		Backlog bool          `json:"backlog"`
+		Rewrite bool          `json:"rewrite"`
+		Breaker *BreakerStats `json:"breaker,omitempty"`
+		Healthy bool          `json:"healthy,omitempty"`
+		Stats   interface{}   `json:"stats,omitempty"`
 	}{
 		Name:    ib.Name,
 		Url:     ib.Url,
 		Active:  ib.IsActive(),
 		Backlog: ib.fb.IsData(),
 		Rewrite: ib.IsRewriting(),
+		Breaker: ib.breaker.Stats(),
 	}
 	if !withStats {
 		return health
@@ -287,6 +740,11 @@ func (ib *Backend) GetHealth(ic *Circle, withStats bool) interface{} {
 			inplace, incorrect := 0, 0
 			measurements := ib.GetMeasurements(db)
 			for _, meas := range measurements {
+				if ic.ShardTags.IsSharded(db, meas) {
+					// points of a sharded measurement are spread across all backends
+					inplace++
+					continue
+				}
 				key := GetKey(db, meas)
 				nb := ic.GetBackend(key)
 				if nb.Url == ib.Url {
@@ -0,0 +1,394 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxql"
+	"github.com/tixff/influx-proxy/util"
+)
+
+func newTestProxyConfig(t *testing.T) *ProxyConfig {
+	dir, err := ioutil.TempDir("", "influx-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	cfg := &ProxyConfig{
+		Circles: []*CircleConfig{
+			{Name: "circle-1", Backends: []*BackendConfig{{Name: "b1", Url: "http://127.0.0.1:8086"}}},
+		},
+		DataDir: dir,
+	}
+	cfg.setDefault()
+	return cfg
+}
+
+// newTestCircles returns n circles hashed by name, each with a simple backend
+func newTestCircles(n int) []*Circle {
+	circles := make([]*Circle, n)
+	for i := 0; i < n; i++ {
+		circles[i] = &Circle{CircleId: i, Name: fmt.Sprintf("circle-%d", i+1), hashKey: "name"}
+		circles[i].SetBackends([]*Backend{NewSimpleBackend(&BackendConfig{Name: fmt.Sprintf("b%d", i+1)})})
+	}
+	return circles
+}
+
+func TestBackendCloseFlush(t *testing.T) {
+	var lines int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			b, _ := ioutil.ReadAll(req.Body)
+			p, err := GzipDecompress(b)
+			if err == nil {
+				atomic.AddInt32(&lines, int32(bytes.Count(p, []byte{'\n'})))
+			}
+		}
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	be := NewBackend(&BackendConfig{Name: "flush", Url: ts.URL}, newTestProxyConfig(t))
+	for i := 0; i < 10; i++ {
+		be.WritePoint(&LinePoint{Db: "db", Line: []byte("cpu value=1\n")})
+	}
+	be.Close()
+	if n := atomic.LoadInt32(&lines); n != 10 {
+		t.Errorf("lines written: got %d, want 10", n)
+	}
+}
+
+func TestBackendCloseSpool(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			<-release
+			return
+		}
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	be := NewBackend(&BackendConfig{Name: "spool", Url: ts.URL}, newTestProxyConfig(t))
+	be.WritePoint(&LinePoint{Db: "db", Line: []byte("cpu value=1\n")})
+	closed := make(chan struct{})
+	go func() {
+		be.Close()
+		close(closed)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	be.SpoolAll()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend not closed after spool all")
+	}
+	if !be.fb.IsData() {
+		t.Error("points not spooled")
+	}
+}
+
+func TestBackendPauseRewrite(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	be := NewBackend(&BackendConfig{Name: "pause", Url: ts.URL}, newTestProxyConfig(t))
+	defer be.Close()
+	be.PauseRewrite()
+	be.fb.Write([]byte("db cpu value=1\n"))
+	be.RewriteNow()
+	time.Sleep(100 * time.Millisecond)
+	if !be.fb.IsData() {
+		t.Error("spool rewritten while paused")
+	}
+	be.ResumeRewrite()
+	for i := 0; i < 50 && be.fb.IsData(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if be.fb.IsData() {
+		t.Error("spool not rewritten after resume")
+	}
+}
+
+func TestBackendYieldLiveWrites(t *testing.T) {
+	be := NewBackend(&BackendConfig{Name: "yield", Url: "http://127.0.0.1:1"}, newTestProxyConfig(t))
+	defer be.Close()
+	atomic.AddInt32(&be.liveWrites, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		atomic.AddInt32(&be.liveWrites, -1)
+		notify(be.chLiveIdle)
+	}()
+	start := time.Now()
+	if !be.yieldLiveWrites() {
+		t.Fatal("yield aborted")
+	}
+	if d := time.Since(start); d < 100*time.Millisecond || d >= time.Second {
+		t.Errorf("yield: got %s, want until the live write is done", d)
+	}
+}
+
+func TestBackendReloadClosed(t *testing.T) {
+	cfg := newTestProxyConfig(t)
+	be := NewBackend(&BackendConfig{Name: "reload", Url: "http://127.0.0.1:1"}, cfg)
+	be.Close()
+	done := make(chan struct{})
+	go func() {
+		be.Reload(cfg)
+		be.Reload(cfg)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reload blocked on a closed backend")
+	}
+}
+
+func TestBackendRetentionPolicy(t *testing.T) {
+	var fail int32 = 1
+	rps := make(chan string, 4)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			if atomic.LoadInt32(&fail) == 1 {
+				w.WriteHeader(500)
+				return
+			}
+			rps <- req.URL.Query().Get("db") + ":" + req.URL.Query().Get("rp")
+		}
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+
+	be := NewBackend(&BackendConfig{Name: "rp", Url: ts.URL}, newTestProxyConfig(t))
+	defer be.Close()
+	be.PauseRewrite()
+	be.WritePoint(&LinePoint{Db: "db", Rp: "rp1", Line: []byte("cpu value=1\n")})
+	be.WritePoint(&LinePoint{Db: "db", Line: []byte("cpu value=2\n")})
+	for i := 0; i < 300 && be.fb.Stats().Records < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := be.fb.Stats().Records; n != 2 {
+		t.Fatalf("spooled records: got %d, want 2", n)
+	}
+
+	// the spooled records are rewritten with their retention policies
+	atomic.StoreInt32(&fail, 0)
+	be.SetActive(true)
+	be.ResumeRewrite()
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case rp := <-rps:
+			got[rp] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("spool not rewritten")
+		}
+	}
+	if !got["db:rp1"] || !got["db:"] {
+		t.Errorf("rewritten: got %v", got)
+	}
+}
+
+func TestQueryHedged(t *testing.T) {
+	newServer := func(name string, delay time.Duration) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			select {
+			case <-time.After(delay):
+			case <-req.Context().Done():
+				return
+			}
+			fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":"%s"}]}]}`, name)
+		}))
+	}
+	slow, fast := newServer("slow", 5*time.Second), newServer("fast", 0)
+	defer slow.Close()
+	defer fast.Close()
+
+	ip := &Proxy{Circles: newTestCircles(2), ReadPolicy: &randomPolicy{}}
+	for i, ts := range []*httptest.Server{slow, fast} {
+		ip.Circles[i].SetBackends([]*Backend{NewSimpleBackend(&BackendConfig{Name: fmt.Sprintf("b%d", i), Url: ts.URL})})
+	}
+	for i := 0; i < 4; i++ {
+		start := time.Now()
+		req := NewQueryRequest("GET", "db", "select * from cpu", "")
+		body, err := QueryHedged(httptest.NewRecorder(), req, ip, GetKey("db", "cpu"), 50*time.Millisecond)
+		if err != nil || !bytes.Contains(body, []byte("fast")) {
+			t.Fatalf("hedged query: got %s %v", body, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("hedged query took %s", elapsed)
+		}
+	}
+}
+
+type chunkRecorder struct {
+	*httptest.ResponseRecorder
+	chunks chan string
+}
+
+func (cr *chunkRecorder) Write(p []byte) (int, error) {
+	cr.chunks <- string(p)
+	return len(p), nil
+}
+
+func TestQueryShowChunked(t *testing.T) {
+	release := make(chan struct{})
+	newServer := func(values string, wait bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if wait {
+				<-release
+			}
+			fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":%s}]}]}`, values)
+		}))
+	}
+	fast, slow := newServer(`[["cpu"]]`, false), newServer(`[["cpu"],["disk"]]`, true)
+	defer fast.Close()
+	defer slow.Close()
+	var once sync.Once
+	defer once.Do(func() { close(release) })
+
+	ip := &Proxy{Circles: newTestCircles(2)}
+	for i, ts := range []*httptest.Server{fast, slow} {
+		ip.Circles[i].SetBackends([]*Backend{NewSimpleBackend(&BackendConfig{Name: fmt.Sprintf("b%d", i), Url: ts.URL})})
+	}
+	stmt, _ := influxql.ParseStatement("show measurements")
+	req := NewQueryRequest("GET", "db", "show measurements", "")
+	req.URL = &url.URL{}
+	req.Form.Set("chunked", "true")
+	w := &chunkRecorder{ResponseRecorder: httptest.NewRecorder(), chunks: make(chan string, 4)}
+	done := make(chan struct{})
+	go func() {
+		QueryShowQL(w, req, ip, stmt)
+		close(done)
+	}()
+
+	// the result of the fast backend is written before the slow one responds
+	want := []string{
+		`{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[["cpu"]]}],"partial":true}]}`,
+		`{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[["disk"]]}],"partial":true}]}`,
+		`{"results":[{"statement_id":0}]}`,
+	}
+	for i, chunk := range want {
+		select {
+		case got := <-w.chunks:
+			if strings.TrimSpace(got) != chunk {
+				t.Errorf("chunk %d: got %s, want %s", i, got, chunk)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("chunk %d not written", i)
+		}
+		if i == 0 {
+			once.Do(func() { close(release) })
+		}
+	}
+	<-done
+}
+
+func TestResponseError(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		want   string
+	}{
+		{status: 400, body: `{"error":"bad query"}`, want: "bad query"},
+		{status: 502, body: "bad gateway\n", want: "bad gateway"},
+		{status: 503, body: "", want: "Service Unavailable"},
+	}
+	for _, tt := range tests {
+		if err := responseError(tt.status, []byte(tt.body)); err.Error() != tt.want {
+			t.Errorf("%d %q: got %s, want %s", tt.status, tt.body, err, tt.want)
+		}
+	}
+}
+
+func TestProxyMetricDB(t *testing.T) {
+	tests := []struct {
+		dbs  []string
+		db   string
+		want string
+	}{
+		{[]string{"db1"}, "db1", "db1"},
+		{[]string{"db1"}, "db2", otherDB},
+		{nil, "db1", otherDB},
+	}
+	for _, tt := range tests {
+		ip := &Proxy{DBSet: util.NewSetFromSlice(tt.dbs)}
+		if got := ip.metricDB(tt.db); got != tt.want {
+			t.Errorf("db %s in %v: got %s, want %s", tt.db, tt.dbs, got, tt.want)
+		}
+	}
+}
+
+func TestProxyReplicaKey(t *testing.T) {
+	ip := &Proxy{ShardTags: ShardTags{"db": {"cpu": []string{"host"}}}}
+	tests := []struct {
+		meas string
+		tags map[string]string
+		key  string
+		ok   bool
+	}{
+		{"mem", nil, "db,mem", true},
+		{"cpu", map[string]string{"host": "a", "region": "us"}, GetShardKey("db", "cpu", []string{"host"}, []string{"a"}), true},
+		{"cpu", map[string]string{"region": "us"}, "", false},
+	}
+	for _, tt := range tests {
+		if key, ok := ip.ReplicaKey("db", tt.meas, tt.tags); key != tt.key || ok != tt.ok {
+			t.Errorf("%s %v: got %s %v, want %s %v", tt.meas, tt.tags, key, ok, tt.key, tt.ok)
+		}
+	}
+}
+
+func TestExpandMeasurementsInactive(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[["cpu1"],["cpu2"]]}]}]}`)
+	}))
+	defer ts.Close()
+	circle := newTestCircles(1)[0]
+	up, down := NewSimpleBackend(&BackendConfig{Name: "up", Url: ts.URL}), NewSimpleBackend(&BackendConfig{Name: "down", Url: ts.URL})
+	down.active.Store(false)
+	circle.SetBackends([]*Backend{up, down})
+
+	stmt, _ := influxql.ParseStatement("select * from /cpu.*/")
+	req := NewQueryRequest("GET", "db", stmt.String(), "")
+	measurements, inactive, err := ExpandMeasurements(req, circle, stmt.(*influxql.SelectStatement).Sources, "db")
+	if err != nil || len(measurements) != 2 || inactive != 1 {
+		t.Errorf("got %v, inactive %d, %v", measurements, inactive, err)
+	}
+}
+
+func TestQueryHedgedServerError(t *testing.T) {
+	newServer := func(status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(status)
+			fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":"%d"}]}]}`, status)
+		}))
+	}
+	failed, healthy := newServer(500), newServer(200)
+	defer failed.Close()
+	defer healthy.Close()
+
+	// the server error of the first circle is not returned before the hedge in the next circle
+	ip := &Proxy{Circles: newTestCircles(2), ReadPolicy: NewReadPolicy(&ProxyConfig{ReadPolicy: ReadPolicyPreferred, PreferredCircles: []string{"circle-1"}})}
+	for i, ts := range []*httptest.Server{failed, healthy} {
+		ip.Circles[i].SetBackends([]*Backend{NewSimpleBackend(&BackendConfig{Name: fmt.Sprintf("b%d", i), Url: ts.URL})})
+	}
+	req := NewQueryRequest("GET", "db", "select * from cpu", "")
+	body, err := QueryHedged(httptest.NewRecorder(), req, ip, GetKey("db", "cpu"), time.Second)
+	if err != nil || !bytes.Contains(body, []byte("200")) {
+		t.Errorf("hedged query: got %s %v", body, err)
+	}
+}
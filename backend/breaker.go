@@ -0,0 +1,194 @@
+package backend
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerHalfOpen = "half-open"
+	BreakerOpen     = "open"
+)
+
+var (
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+)
+
+// CircuitBreaker opens when too many of the recent requests to a backend fail or are slow, an open breaker
+// turns half-open after the open timeout and lets one probe request through at a time, a successful probe
+// closes the breaker and a failed one opens it again
+type CircuitBreaker struct {
+	lock        sync.Mutex
+	name        string
+	enabled     bool
+	window      int
+	minRequests int
+	failureRate float64
+	slow        time.Duration
+	openTimeout time.Duration
+	state       string
+	openedAt    time.Time
+	probing     bool
+	outcomes    []bool
+	next        int
+	count       int
+	failures    int
+}
+
+type BreakerStats struct {
+	State    string `json:"state"`
+	Requests int    `json:"requests"`
+	Failures int    `json:"failures"`
+}
+
+func NewCircuitBreaker(name string) *CircuitBreaker {
+	return &CircuitBreaker{name: name, state: BreakerClosed}
+}
+
+// Reload applies the breaker settings of pxcfg, the recent outcomes are reset when the window changes
+func (cb *CircuitBreaker) Reload(pxcfg *ProxyConfig) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	cb.enabled = pxcfg.BreakerEnabled
+	cb.minRequests = pxcfg.BreakerMinRequests
+	cb.failureRate = pxcfg.BreakerFailureRate
+	cb.slow = time.Duration(pxcfg.BreakerSlowThreshold) * time.Millisecond
+	cb.openTimeout = time.Duration(pxcfg.BreakerOpenTimeout) * time.Second
+	if cb.window != pxcfg.BreakerWindow {
+		cb.window = pxcfg.BreakerWindow
+		cb.reset()
+	}
+	if !cb.enabled {
+		cb.setState(BreakerClosed)
+		cb.reset()
+	}
+}
+
+func (cb *CircuitBreaker) reset() {
+	cb.outcomes = make([]bool, cb.window)
+	cb.next, cb.count, cb.failures = 0, 0, 0
+	cb.probing = false
+}
+
+func (cb *CircuitBreaker) setState(state string) {
+	if cb.state != state {
+		log.Printf("circuit breaker %s: %s", state, cb.name)
+	}
+	cb.state = state
+	switch state {
+	case BreakerClosed:
+		BackendBreakerState.WithLabelValues(cb.name).Set(0)
+	case BreakerHalfOpen:
+		BackendBreakerState.WithLabelValues(cb.name).Set(1)
+	case BreakerOpen:
+		BackendBreakerState.WithLabelValues(cb.name).Set(2)
+	}
+}
+
+func (cb *CircuitBreaker) open() {
+	cb.setState(BreakerOpen)
+	cb.openedAt = time.Now()
+	cb.reset()
+}
+
+// currentState turns an open breaker half-open once the open timeout is passed
+func (cb *CircuitBreaker) currentState() string {
+	if cb.state == BreakerOpen && time.Since(cb.openedAt) >= cb.openTimeout {
+		cb.setState(BreakerHalfOpen)
+	}
+	return cb.state
+}
+
+func (cb *CircuitBreaker) State() string {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	return cb.currentState()
+}
+
+func (cb *CircuitBreaker) IsOpen() bool {
+	return cb.State() == BreakerOpen
+}
+
+// Allow reports whether a request can be sent, an allowed request must be followed by Record or Cancel
+func (cb *CircuitBreaker) Allow() bool {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if !cb.enabled {
+		return true
+	}
+	switch cb.currentState() {
+	case BreakerClosed:
+		return true
+	case BreakerHalfOpen:
+		if cb.probing {
+			return false
+		}
+		cb.probing = true
+		return true
+	}
+	return false
+}
+
+// Record records the outcome of an allowed request, a request slower than the slow threshold is failed
+func (cb *CircuitBreaker) Record(failed bool, latency time.Duration) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if !cb.enabled {
+		return
+	}
+	if cb.slow > 0 && latency > cb.slow {
+		failed = true
+	}
+	switch cb.currentState() {
+	case BreakerHalfOpen:
+		if failed {
+			cb.open()
+		} else {
+			cb.setState(BreakerClosed)
+			cb.reset()
+		}
+		return
+	case BreakerOpen:
+		// the request was sent before the breaker opened
+		return
+	}
+
+	if cb.count == cb.window {
+		if cb.outcomes[cb.next] {
+			cb.failures--
+		}
+	} else {
+		cb.count++
+	}
+	cb.outcomes[cb.next] = failed
+	if failed {
+		cb.failures++
+	}
+	cb.next = (cb.next + 1) % cb.window
+	if cb.count >= cb.minRequests && float64(cb.failures) >= cb.failureRate*float64(cb.count) {
+		log.Printf("circuit breaker failures: %s, %d of %d requests", cb.name, cb.failures, cb.count)
+		cb.open()
+	}
+}
+
+// Cancel releases an allowed request whose outcome is unknown, such as a canceled query
+func (cb *CircuitBreaker) Cancel() {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if cb.state == BreakerHalfOpen {
+		cb.probing = false
+	}
+}
+
+// Stats returns nil if the breaker is disabled
+func (cb *CircuitBreaker) Stats() *BreakerStats {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if !cb.enabled {
+		return nil
+	}
+	return &BreakerStats{State: cb.currentState(), Requests: cb.count, Failures: cb.failures}
+}
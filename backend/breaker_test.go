@@ -0,0 +1,97 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	cfg := newTestProxyConfig(t)
+	cfg.BreakerEnabled, cfg.BreakerWindow, cfg.BreakerMinRequests, cfg.BreakerSlowThreshold = true, 4, 4, 100
+	cb := NewCircuitBreaker("breaker")
+	cb.Reload(cfg)
+	cb.Record(true, 0)
+	cb.Record(false, 0)
+	cb.Record(false, 0)
+	if cb.State() != BreakerClosed {
+		t.Fatalf("state before min requests: got %s", cb.State())
+	}
+	cb.Record(false, time.Second)
+	if cb.State() != BreakerOpen || cb.Allow() {
+		t.Fatalf("state after failures: got %s", cb.State())
+	}
+
+	// the open timeout is passed, one probe is allowed at a time
+	cb.openedAt = time.Now().Add(-time.Hour)
+	if !cb.Allow() || cb.State() != BreakerHalfOpen || cb.Allow() {
+		t.Fatalf("half-open probe: got %s", cb.State())
+	}
+	cb.Record(true, 0)
+	if cb.State() != BreakerOpen {
+		t.Fatalf("state after failed probe: got %s", cb.State())
+	}
+	cb.openedAt = time.Now().Add(-time.Hour)
+	cb.Allow()
+	cb.Record(false, 0)
+	if cb.State() != BreakerClosed || !cb.Allow() {
+		t.Fatalf("state after successful probe: got %s", cb.State())
+	}
+	if stats := cb.Stats(); stats.Requests != 0 || stats.Failures != 0 {
+		t.Errorf("stats after close: got %+v", stats)
+	}
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	tests := []struct {
+		enabled bool
+		every   int
+		allow   bool
+		stats   *BreakerStats
+	}{
+		{true, 4, true, &BreakerStats{State: BreakerClosed, Requests: 4, Failures: 1}},
+		{true, 2, false, &BreakerStats{State: BreakerOpen}},
+		{false, 1, true, nil},
+	}
+	for _, tt := range tests {
+		cfg := newTestProxyConfig(t)
+		cfg.BreakerEnabled, cfg.BreakerWindow, cfg.BreakerMinRequests = tt.enabled, 4, 4
+		cb := NewCircuitBreaker("window")
+		cb.Reload(cfg)
+		// every nth of the 10 requests fails
+		for i := 0; i < 10; i++ {
+			cb.Record(i%tt.every == 0, 0)
+		}
+		if allow, stats := cb.Allow(), cb.Stats(); allow != tt.allow || !reflect.DeepEqual(stats, tt.stats) {
+			t.Errorf("enabled %v every %d: got %v %+v, want %v %+v", tt.enabled, tt.every, allow, stats, tt.allow, tt.stats)
+		}
+	}
+}
+
+func TestCircuitBreakerCanceledQuery(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	}))
+	defer ts.Close()
+	hb := NewSimpleHttpBackend(&BackendConfig{Name: "cancel", Url: ts.URL})
+	defer hb.Close()
+	cfg := newTestProxyConfig(t)
+	cfg.BreakerEnabled = true
+	hb.breaker.Reload(cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL, nil)
+	req.Form = url.Values{"q": []string{"select * from cpu"}}
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err := hb.roundTripQuery(req)
+	if err == nil {
+		t.Fatal("query not canceled")
+	}
+	if stats := hb.breaker.Stats(); stats.Requests != 0 || stats.Failures != 0 {
+		t.Errorf("stats after cancel: got %+v", stats)
+	}
+}
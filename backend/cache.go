@@ -0,0 +1,281 @@
+package backend
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxql"
+)
+
+// QueryCache is a lru cache of select results, an entry expires after the ttl, and is removed when the size
+// of all entries exceeds the max size or when a measurement it reads is deleted or dropped
+type QueryCache struct {
+	lock        sync.Mutex
+	ttl         time.Duration
+	maxSize     int
+	minWindow   time.Duration
+	size        int
+	lru         *list.List
+	entries     map[string]*list.Element
+	generations map[string]uint64
+}
+
+type cacheEntry struct {
+	key          string
+	db           string
+	measurements []*influxql.Measurement
+	header       http.Header
+	body         []byte
+	expire       time.Time
+	generation   uint64
+}
+
+func NewQueryCache(pxcfg *ProxyConfig) *QueryCache {
+	qc := &QueryCache{lru: list.New(), entries: make(map[string]*list.Element), generations: make(map[string]uint64)}
+	qc.Reload(pxcfg)
+	return qc
+}
+
+// Reload applies the cache settings of pxcfg, all entries are removed when the cache is disabled
+func (qc *QueryCache) Reload(pxcfg *ProxyConfig) {
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
+	qc.ttl = time.Duration(pxcfg.QueryCacheTTL) * time.Second
+	qc.maxSize = pxcfg.QueryCacheMaxSize
+	qc.minWindow = time.Duration(pxcfg.QueryCacheMinWindow) * time.Second
+	if qc.ttl <= 0 {
+		qc.removeIf(func(*cacheEntry) bool { return true })
+	}
+	qc.evict()
+}
+
+// Query returns the cached result of the select, or runs query and caches its result,
+// the query is run without cache if the select is not cacheable
+func (qc *QueryCache) Query(w http.ResponseWriter, req *http.Request, stmt influxql.Statement, db string, query func() ([]byte, error)) (body []byte, err error) {
+	sstmt, ok := stmt.(*influxql.SelectStatement)
+	if !ok || req.FormValue("chunked") == "true" {
+		return query()
+	}
+	qc.lock.Lock()
+	ttl, minWindow := qc.ttl, qc.minWindow
+	qc.lock.Unlock()
+	if ttl <= 0 {
+		return query()
+	}
+	ttl, ok = cacheTTL(sstmt, ttl, minWindow)
+	if !ok {
+		QueryCacheRequests.WithLabelValues("bypass").Inc()
+		return query()
+	}
+
+	key := strings.Join([]string{db, req.FormValue("rp"), req.FormValue("epoch"), req.FormValue("pretty"),
+		req.Header.Get("Accept-Encoding"), sstmt.String()}, "\n")
+	if entry := qc.get(key); entry != nil {
+		QueryCacheRequests.WithLabelValues("hit").Inc()
+		CopyHeader(w.Header(), entry.header)
+		return entry.body, nil
+	}
+	QueryCacheRequests.WithLabelValues("miss").Inc()
+	entry := &cacheEntry{key: key, db: db, measurements: GetMeasurementsFromStatement(sstmt)}
+	qc.lock.Lock()
+	entry.generation = qc.generation(entry)
+	qc.lock.Unlock()
+	body, err = query()
+	if err == nil && body != nil && !hasResultError(body, w.Header().Get("Content-Encoding") == "gzip") {
+		entry.header = w.Header().Clone()
+		entry.body = body
+		entry.expire = time.Now().Add(ttl)
+		qc.set(entry)
+	}
+	return
+}
+
+// hasResultError returns true if the json body has an error in it or in any result
+func hasResultError(body []byte, gzipped bool) bool {
+	if gzipped {
+		var err error
+		body, err = GzipDecompress(body)
+		if err != nil {
+			return true
+		}
+	}
+	if !bytes.Contains(body, []byte(`"error"`)) {
+		return false
+	}
+	rsp, err := ResponseFromResponseBytes(body)
+	if err != nil {
+		return false
+	}
+	if rsp.Err != "" {
+		return true
+	}
+	for _, r := range rsp.Results {
+		if r.Err != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// generation returns the sum of the generations of the databases read by the entry, which is increased
+// once any of them is invalidated, so that a result queried before the invalidation is not cached
+func (qc *QueryCache) generation(entry *cacheEntry) (gen uint64) {
+	gen = qc.generations[entry.db]
+	for _, m := range entry.measurements {
+		if m.Database != "" && m.Database != entry.db {
+			gen += qc.generations[m.Database]
+		}
+	}
+	return
+}
+
+// cacheTTL returns the ttl of the select, a time bucketed select expires within its interval,
+// and a select relative to now() without time buckets is not cacheable if its window is narrower than min window
+func cacheTTL(stmt *influxql.SelectStatement, ttl, minWindow time.Duration) (time.Duration, bool) {
+	if interval, err := stmt.GroupByInterval(); err != nil {
+		return 0, false
+	} else if interval > 0 {
+		if interval < ttl {
+			ttl = interval
+		}
+		return ttl, true
+	}
+	var relative bool
+	influxql.WalkFunc(stmt, func(n influxql.Node) {
+		if call, ok := n.(*influxql.Call); ok && strings.ToLower(call.Name) == "now" {
+			relative = true
+		}
+	})
+	if !relative {
+		return ttl, true
+	}
+	now := time.Now()
+	_, tr, err := influxql.ConditionExpr(stmt.Condition, &influxql.NowValuer{Now: now})
+	if err != nil {
+		return 0, false
+	}
+	if tr.MinTime().After(now.Add(-minWindow)) {
+		return 0, false
+	}
+	return ttl, true
+}
+
+func (qc *QueryCache) get(key string) *cacheEntry {
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
+	elem, ok := qc.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expire) {
+		qc.remove(elem)
+		return nil
+	}
+	qc.lru.MoveToFront(elem)
+	return entry
+}
+
+func (qc *QueryCache) set(entry *cacheEntry) {
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
+	if qc.ttl <= 0 || len(entry.body) > qc.maxSize || qc.generation(entry) != entry.generation {
+		return
+	}
+	if elem, ok := qc.entries[entry.key]; ok {
+		qc.remove(elem)
+	}
+	qc.entries[entry.key] = qc.lru.PushFront(entry)
+	qc.size += len(entry.body)
+	qc.evict()
+}
+
+func (qc *QueryCache) remove(elem *list.Element) {
+	entry := qc.lru.Remove(elem).(*cacheEntry)
+	delete(qc.entries, entry.key)
+	qc.size -= len(entry.body)
+}
+
+func (qc *QueryCache) removeIf(fn func(entry *cacheEntry) bool) {
+	for elem := qc.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if fn(elem.Value.(*cacheEntry)) {
+			qc.remove(elem)
+		}
+		elem = next
+	}
+}
+
+// evict removes the least recently used entries until the size is within the max size
+func (qc *QueryCache) evict() {
+	for qc.size > qc.maxSize && qc.lru.Len() > 0 {
+		qc.remove(qc.lru.Back())
+	}
+	QueryCacheBytes.Set(float64(qc.size))
+}
+
+// Invalidate removes the entries reading any of the measurements in db, a regex matches the measurement names
+func (qc *QueryCache) Invalidate(db string, measurements []*influxql.Measurement) {
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
+	qc.generations[db]++
+	for _, m := range measurements {
+		if m.Database != "" && m.Database != db {
+			qc.generations[m.Database]++
+		}
+	}
+	qc.removeIf(func(entry *cacheEntry) bool {
+		for _, m := range measurements {
+			for _, em := range entry.measurements {
+				if matchMeasurement(db, m, entry.db, em) {
+					return true
+				}
+			}
+		}
+		return false
+	})
+	QueryCacheBytes.Set(float64(qc.size))
+}
+
+// InvalidateDB removes the entries reading db
+func (qc *QueryCache) InvalidateDB(db string) {
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
+	qc.generations[db]++
+	qc.removeIf(func(entry *cacheEntry) bool {
+		if entry.db == db {
+			return true
+		}
+		for _, em := range entry.measurements {
+			if em.Database == db {
+				return true
+			}
+		}
+		return false
+	})
+	QueryCacheBytes.Set(float64(qc.size))
+}
+
+func matchMeasurement(adb string, a *influxql.Measurement, bdb string, b *influxql.Measurement) bool {
+	if a.Database != "" {
+		adb = a.Database
+	}
+	if b.Database != "" {
+		bdb = b.Database
+	}
+	switch {
+	case adb != bdb:
+		return false
+	case a.Regex != nil && b.Regex != nil:
+		return true
+	case a.Regex != nil:
+		return a.Regex.Val.MatchString(b.Name)
+	case b.Regex != nil:
+		return b.Regex.Val.MatchString(a.Name)
+	}
+	return a.Name == b.Name
+}
@@ -0,0 +1,117 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func cacheQuery(t *testing.T, qc *QueryCache, q string, runs *int) string {
+	stmt, err := ParseStatement(q, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "/query", nil)
+	body, _ := qc.Query(httptest.NewRecorder(), req, stmt, "db", func() ([]byte, error) {
+		*runs++
+		return []byte(q), nil
+	})
+	return string(body)
+}
+
+func TestQueryCache(t *testing.T) {
+	qc := NewQueryCache(&ProxyConfig{QueryCacheTTL: 10, QueryCacheMaxSize: 100, QueryCacheMinWindow: 3600})
+	var runs int
+	for _, q := range []string{
+		"select * from cpu where time > '2020-01-01T00:00:00Z'",
+		"select mean(v) from cpu where time > now() - 5m group by time(1m)",
+		"select * from cpu where time > now() - 2h",
+		"select * from mem",
+	} {
+		cacheQuery(t, qc, q, &runs)
+		if cacheQuery(t, qc, q, &runs) != q {
+			t.Errorf("cached body: %s", q)
+		}
+	}
+	if runs != 4 {
+		t.Errorf("cacheable queries run: got %d, want 4", runs)
+	}
+
+	runs = 0
+	q := "select * from cpu where time > now() - 5m"
+	cacheQuery(t, qc, q, &runs)
+	cacheQuery(t, qc, q, &runs)
+	if runs != 2 {
+		t.Errorf("narrow window queries run: got %d, want 2", runs)
+	}
+
+	// the least recently used entries are evicted beyond the max size
+	runs = 0
+	cacheQuery(t, qc, "select * from mem", &runs)
+	cacheQuery(t, qc, "select * from disk where time > '2020-01-01T00:00:00Z'", &runs)
+	if qc.size > 100 || qc.lru.Len() != 2 {
+		t.Errorf("evicted size: %d, entries: %d", qc.size, qc.lru.Len())
+	}
+	cacheQuery(t, qc, "select * from mem", &runs)
+	if runs != 1 {
+		t.Errorf("recently used entry evicted: %d", runs)
+	}
+}
+
+func TestQueryCacheInvalidate(t *testing.T) {
+	qc := NewQueryCache(&ProxyConfig{QueryCacheTTL: 10, QueryCacheMaxSize: 1000, QueryCacheMinWindow: 3600})
+	var runs int
+	for _, q := range []string{"select * from cpu", "select * from mem", "select * from /^disk/"} {
+		cacheQuery(t, qc, q, &runs)
+	}
+	stmt, _ := ParseStatement("drop measurement cpu", "")
+	qc.Invalidate("db", GetMeasurementsFromStatement(stmt))
+	stmt, _ = ParseStatement("delete from disk_io", "")
+	qc.Invalidate("db", GetMeasurementsFromStatement(stmt))
+	if _, ok := qc.entries["db\n\n\n\n\nSELECT * FROM mem"]; !ok || qc.lru.Len() != 1 {
+		t.Errorf("entries after invalidate: %d", qc.lru.Len())
+	}
+
+	qc.InvalidateDB("db")
+	if qc.lru.Len() != 0 || qc.size != 0 {
+		t.Errorf("entries after drop database: %d", qc.lru.Len())
+	}
+
+	// an expired entry is queried again
+	cacheQuery(t, qc, "select * from cpu", &runs)
+	qc.lru.Front().Value.(*cacheEntry).expire = time.Now().Add(-time.Second)
+	runs = 0
+	cacheQuery(t, qc, "select * from cpu", &runs)
+	if runs != 1 {
+		t.Errorf("expired entry not queried")
+	}
+}
+
+func TestQueryCacheStale(t *testing.T) {
+	qc := NewQueryCache(&ProxyConfig{QueryCacheTTL: 10, QueryCacheMaxSize: 1000, QueryCacheMinWindow: 3600})
+	stmt, _ := ParseStatement("select * from cpu", "")
+	drop, _ := ParseStatement("drop measurement cpu", "")
+	tests := []struct {
+		name  string
+		body  string
+		query func()
+	}{
+		{name: "error", body: `{"results":[{"statement_id":0,"error":"timeout"}]}`},
+		{name: "invalidated", body: `{"results":[{"statement_id":0}]}`, query: func() {
+			qc.Invalidate("db", GetMeasurementsFromStatement(drop))
+		}},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "/query", nil)
+		qc.Query(httptest.NewRecorder(), req, stmt, "db", func() ([]byte, error) {
+			if tt.query != nil {
+				tt.query()
+			}
+			return []byte(tt.body), nil
+		})
+		if qc.lru.Len() != 0 {
+			t.Errorf("%s: result cached", tt.name)
+		}
+	}
+}
@@ -12,8 +12,10 @@ type Circle struct {
 	Name         string
 	Backends     []*Backend
 	WriteOnly    bool
+	ShardTags    ShardTags
+	hashKey      string
 	router       *consistent.Consistent
-	routerCaches sync.Map
+	routerCaches *sync.Map
 	mapToBackend map[string]*Backend
 }
 
@@ -23,7 +25,10 @@ func NewCircle(cfg *CircleConfig, pxcfg *ProxyConfig, circleId int) (ic *Circle)
 		Name:         cfg.Name,
 		Backends:     make([]*Backend, len(cfg.Backends)),
 		WriteOnly:    false,
+		ShardTags:    pxcfg.ShardTags,
+		hashKey:      pxcfg.HashKey,
 		router:       consistent.New(),
+		routerCaches: &sync.Map{},
 		mapToBackend: make(map[string]*Backend),
 	}
 	ic.router.NumberOfReplicas = 256
@@ -34,6 +39,24 @@ func NewCircle(cfg *CircleConfig, pxcfg *ProxyConfig, circleId int) (ic *Circle)
 	return
 }
 
+// SetBackends replaces the backends of the circle, and rebuilds the router and its caches
+func (ic *Circle) SetBackends(backends []*Backend) {
+	ic.Backends = backends
+	ic.router = consistent.New()
+	ic.router.NumberOfReplicas = 256
+	ic.mapToBackend = make(map[string]*Backend)
+	for idx, be := range backends {
+		ic.addRouter(be, idx, ic.hashKey)
+	}
+	ic.routerCaches = &sync.Map{}
+}
+
+// snapshot returns a copy of the circle which keeps its backends and router when they are replaced
+func (ic *Circle) snapshot() *Circle {
+	c := *ic
+	return &c
+}
+
 func (ic *Circle) addRouter(be *Backend, idx int, hashKey string) {
 	if hashKey == "name" {
 		ic.router.Add(be.Name)
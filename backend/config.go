@@ -3,6 +3,7 @@ package backend
 import (
 	"encoding/json"
 	"errors"
+	"io/ioutil"
 	"log"
 	"os"
 
@@ -19,6 +20,16 @@ var (
 	ErrEmptyBackendName      = errors.New("backend name cannot be empty")
 	ErrDuplicatedBackendName = errors.New("backend name duplicated")
 	ErrInvalidHashKey        = errors.New("invalid hash_key, require idx, exi, name or url")
+	ErrInvalidConsistency    = errors.New("invalid write_consistency, require any, one, quorum or all")
+	ErrEmptyShardTag         = errors.New("shard tag cannot be empty")
+	ErrInvalidQueryMode      = errors.New("invalid query_mode, require single or merge")
+	ErrInvalidSpoolPolicy    = errors.New("invalid spool_policy, require drop-oldest or reject-new")
+	ErrInvalidFailureRate    = errors.New("invalid breaker_failure_rate, require a ratio no more than 1")
+	ErrInvalidReadPolicy     = errors.New("invalid read_policy, require random, preferred, least-outstanding or ewma-latency")
+	ErrPreferredNotFound     = errors.New("preferred circle not found")
+	ErrEmptyUsername         = errors.New("username cannot be empty")
+	ErrDuplicatedUsername    = errors.New("username duplicated")
+	ErrInvalidPrivilege      = errors.New("invalid privilege, require read, write or all")
 )
 
 type BackendConfig struct { // nolint:golint
@@ -34,28 +45,62 @@ type CircleConfig struct {
 	Backends []*BackendConfig `json:"backends"`
 }
 
+type UserConfig struct {
+	Username   string            `json:"username"`
+	Password   string            `json:"password"`
+	Admin      bool              `json:"admin"`
+	Privileges map[string]string `json:"privileges"`
+}
+
 type ProxyConfig struct {
-	Circles         []*CircleConfig `json:"circles"`
-	ListenAddr      string          `json:"listen_addr"`
-	DBList          []string        `json:"db_list"`
-	DataDir         string          `json:"data_dir"`
-	TLogDir         string          `json:"tlog_dir"`
-	HashKey         string          `json:"hash_key"`
-	FlushSize       int             `json:"flush_size"`
-	FlushTime       int             `json:"flush_time"`
-	CheckInterval   int             `json:"check_interval"`
-	RewriteInterval int             `json:"rewrite_interval"`
-	ConnPoolSize    int             `json:"conn_pool_size"`
-	WriteTimeout    int             `json:"write_timeout"`
-	IdleTimeout     int             `json:"idle_timeout"`
-	Username        string          `json:"username"`
-	Password        string          `json:"password"`
-	AuthEncrypt     bool            `json:"auth_encrypt"`
-	WriteTracing    bool            `json:"write_tracing"`
-	QueryTracing    bool            `json:"query_tracing"`
-	HTTPSEnabled    bool            `json:"https_enabled"`
-	HTTPSCert       string          `json:"https_cert"`
-	HTTPSKey        string          `json:"https_key"`
+	Circles              []*CircleConfig `json:"circles"`
+	ListenAddr           string          `json:"listen_addr"`
+	DBList               []string        `json:"db_list"`
+	DataDir              string          `json:"data_dir"`
+	TLogDir              string          `json:"tlog_dir"`
+	HashKey              string          `json:"hash_key"`
+	ShardTags            ShardTags       `json:"shard_tags"`
+	QueryMode            string          `json:"query_mode"`
+	FlushSize            int             `json:"flush_size"`
+	FlushTime            int             `json:"flush_time"`
+	CheckInterval        int             `json:"check_interval"`
+	RewriteInterval      int             `json:"rewrite_interval"`
+	RewriteConcurrency   int             `json:"rewrite_concurrency"`
+	RewriteRateLimit     int             `json:"rewrite_rate_limit"`
+	RewritePointsLimit   int             `json:"rewrite_points_limit"`
+	ConnPoolSize         int             `json:"conn_pool_size"`
+	WriteTimeout         int             `json:"write_timeout"`
+	IdleTimeout          int             `json:"idle_timeout"`
+	ShutdownTimeout      int             `json:"shutdown_timeout"`
+	WriteConsistency     string          `json:"write_consistency"`
+	MaxBodySize          int             `json:"max_body_size"`
+	HedgeDelay           int             `json:"hedge_delay"`
+	ReadPolicy           string          `json:"read_policy"`
+	PreferredCircles     []string        `json:"preferred_circles"`
+	QueryCacheTTL        int             `json:"query_cache_ttl"`
+	QueryCacheMaxSize    int             `json:"query_cache_max_size"`
+	QueryCacheMinWindow  int             `json:"query_cache_min_window"`
+	WALEnabled           bool            `json:"wal_enabled"`
+	SpoolSegmentSize     int             `json:"spool_segment_size"`
+	SpoolMaxSize         int             `json:"spool_max_size"`
+	SpoolMaxAge          int             `json:"spool_max_age"`
+	SpoolPolicy          string          `json:"spool_policy"`
+	BreakerEnabled       bool            `json:"breaker_enabled"`
+	BreakerWindow        int             `json:"breaker_window"`
+	BreakerMinRequests   int             `json:"breaker_min_requests"`
+	BreakerFailureRate   float64         `json:"breaker_failure_rate"`
+	BreakerSlowThreshold int             `json:"breaker_slow_threshold"`
+	BreakerOpenTimeout   int             `json:"breaker_open_timeout"`
+	Username             string          `json:"username"`
+	Password             string          `json:"password"`
+	AuthEncrypt          bool            `json:"auth_encrypt"`
+	Users                []*UserConfig   `json:"users"`
+	WriteTracing         bool            `json:"write_tracing"`
+	QueryTracing         bool            `json:"query_tracing"`
+	HTTPSEnabled         bool            `json:"https_enabled"`
+	HTTPSCert            string          `json:"https_cert"`
+	HTTPSKey             string          `json:"https_key"`
+	file                 string
 }
 
 func NewFileConfig(cfgfile string) (cfg *ProxyConfig, err error) {
@@ -70,6 +115,7 @@ func NewFileConfig(cfgfile string) (cfg *ProxyConfig, err error) {
 	if err != nil {
 		return
 	}
+	cfg.file = cfgfile
 	cfg.setDefault()
 	err = cfg.checkConfig()
 	if err != nil {
@@ -78,6 +124,43 @@ func NewFileConfig(cfgfile string) (cfg *ProxyConfig, err error) {
 	return
 }
 
+// ReloadFile reads and checks the config file which cfg was loaded from
+func (cfg *ProxyConfig) ReloadFile() (*ProxyConfig, error) {
+	return NewFileConfig(cfg.file)
+}
+
+// SaveFile writes the circles of cfg back to the config file which cfg was loaded from,
+// the other settings of the file are kept as they are
+func (cfg *ProxyConfig) SaveFile() (err error) {
+	fi, err := os.Stat(cfg.file)
+	if err != nil {
+		return
+	}
+	b, err := ioutil.ReadFile(cfg.file)
+	if err != nil {
+		return
+	}
+	raw := make(map[string]json.RawMessage)
+	err = json.Unmarshal(b, &raw)
+	if err != nil {
+		return
+	}
+	raw["circles"], err = json.Marshal(cfg.Circles)
+	if err != nil {
+		return
+	}
+	b, err = json.MarshalIndent(raw, "", "    ")
+	if err != nil {
+		return
+	}
+	tmp := cfg.file + ".tmp"
+	err = ioutil.WriteFile(tmp, append(b, '\n'), fi.Mode())
+	if err != nil {
+		return
+	}
+	return os.Rename(tmp, cfg.file)
+}
+
 func (cfg *ProxyConfig) setDefault() {
 	if cfg.ListenAddr == "" {
 		cfg.ListenAddr = ":7076"
@@ -91,6 +174,18 @@ func (cfg *ProxyConfig) setDefault() {
 	if cfg.HashKey == "" {
 		cfg.HashKey = "idx"
 	}
+	if cfg.QueryMode == "" {
+		cfg.QueryMode = QueryModeSingle
+	}
+	if cfg.ReadPolicy == "" {
+		cfg.ReadPolicy = ReadPolicyRandom
+	}
+	if cfg.QueryCacheMaxSize <= 0 {
+		cfg.QueryCacheMaxSize = 64 * 1024 * 1024
+	}
+	if cfg.QueryCacheMinWindow <= 0 {
+		cfg.QueryCacheMinWindow = 3600
+	}
 	if cfg.FlushSize <= 0 {
 		cfg.FlushSize = 10000
 	}
@@ -103,6 +198,9 @@ func (cfg *ProxyConfig) setDefault() {
 	if cfg.RewriteInterval <= 0 {
 		cfg.RewriteInterval = 10
 	}
+	if cfg.RewriteConcurrency <= 0 {
+		cfg.RewriteConcurrency = 1
+	}
 	if cfg.ConnPoolSize <= 0 {
 		cfg.ConnPoolSize = 20
 	}
@@ -112,14 +210,39 @@ func (cfg *ProxyConfig) setDefault() {
 	if cfg.IdleTimeout <= 0 {
 		cfg.IdleTimeout = 10
 	}
+	if cfg.SpoolSegmentSize <= 0 {
+		cfg.SpoolSegmentSize = 64 * 1024 * 1024
+	}
+	if cfg.SpoolPolicy == "" {
+		cfg.SpoolPolicy = SpoolPolicyDropOldest
+	}
+	if cfg.BreakerWindow <= 0 {
+		cfg.BreakerWindow = 20
+	}
+	if cfg.BreakerMinRequests <= 0 {
+		cfg.BreakerMinRequests = 10
+	}
+	if cfg.BreakerFailureRate <= 0 {
+		cfg.BreakerFailureRate = 0.5
+	}
+	if cfg.BreakerOpenTimeout <= 0 {
+		cfg.BreakerOpenTimeout = 30
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		cfg.ShutdownTimeout = 30
+	}
+	if cfg.WriteConsistency == "" {
+		cfg.WriteConsistency = ConsistencyAny
+	}
 }
 
 func (cfg *ProxyConfig) checkConfig() (err error) {
 	if len(cfg.Circles) == 0 {
 		return ErrEmptyCircles
 	}
-	set := util.NewSet()
+	set, circleNames := util.NewSet(), util.NewSet()
 	for _, circle := range cfg.Circles {
+		circleNames.Add(circle.Name)
 		if len(circle.Backends) == 0 {
 			return ErrEmptyBackends
 		}
@@ -136,6 +259,56 @@ func (cfg *ProxyConfig) checkConfig() (err error) {
 	if cfg.HashKey != "idx" && cfg.HashKey != "exi" && cfg.HashKey != "name" && cfg.HashKey != "url" {
 		return ErrInvalidHashKey
 	}
+	if !CheckConsistency(cfg.WriteConsistency) {
+		return ErrInvalidConsistency
+	}
+	if cfg.QueryMode != QueryModeSingle && cfg.QueryMode != QueryModeMerge {
+		return ErrInvalidQueryMode
+	}
+	if cfg.SpoolPolicy != SpoolPolicyDropOldest && cfg.SpoolPolicy != SpoolPolicyRejectNew {
+		return ErrInvalidSpoolPolicy
+	}
+	switch cfg.ReadPolicy {
+	case ReadPolicyRandom, ReadPolicyLeastOutstanding, ReadPolicyEWMALatency:
+	case ReadPolicyPreferred:
+		for _, name := range cfg.PreferredCircles {
+			if !circleNames[name] {
+				return ErrPreferredNotFound
+			}
+		}
+	default:
+		return ErrInvalidReadPolicy
+	}
+	if cfg.BreakerFailureRate > 1 {
+		return ErrInvalidFailureRate
+	}
+	usernames := util.NewSet()
+	if cfg.Username != "" || cfg.Password != "" {
+		usernames.Add(cfg.Username)
+	}
+	for _, user := range cfg.Users {
+		if user.Username == "" {
+			return ErrEmptyUsername
+		}
+		if usernames[user.Username] {
+			return ErrDuplicatedUsername
+		}
+		usernames.Add(user.Username)
+		for _, p := range user.Privileges {
+			if p != PrivilegeRead && p != PrivilegeWrite && p != PrivilegeAll {
+				return ErrInvalidPrivilege
+			}
+		}
+	}
+	for _, ms := range cfg.ShardTags {
+		for _, tags := range ms {
+			for _, tag := range tags {
+				if tag == "" {
+					return ErrEmptyShardTag
+				}
+			}
+		}
+	}
 	return
 }
 
@@ -145,8 +318,12 @@ func (cfg *ProxyConfig) PrintSummary() {
 		log.Printf("circle %d: %d backends loaded", id, len(circle.Backends))
 	}
 	log.Printf("hash key: %s", cfg.HashKey)
+	log.Printf("write consistency: %s, query mode: %s", cfg.WriteConsistency, cfg.QueryMode)
 	if len(cfg.DBList) > 0 {
 		log.Printf("db list: %v", cfg.DBList)
 	}
-	log.Printf("auth: %t, encrypt: %t", cfg.Username != "" || cfg.Password != "", cfg.AuthEncrypt)
+	if len(cfg.ShardTags) > 0 {
+		log.Printf("shard tags: %v", cfg.ShardTags)
+	}
+	log.Printf("auth: %t, users: %d, encrypt: %t", cfg.Username != "" || cfg.Password != "" || len(cfg.Users) > 0, len(cfg.Users), cfg.AuthEncrypt)
 }
@@ -0,0 +1,174 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	ConsistencyAny    = "any"
+	ConsistencyOne    = "one"
+	ConsistencyQuorum = "quorum"
+	ConsistencyAll    = "all"
+)
+
+var (
+	ErrSpooled = errors.New("spooled to file")
+)
+
+func CheckConsistency(consistency string) bool {
+	return consistency == ConsistencyAny || consistency == ConsistencyOne || consistency == ConsistencyQuorum || consistency == ConsistencyAll
+}
+
+type CircleWriteStatus struct {
+	Id     int    `json:"id"` // nolint:golint
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Err    string `json:"error,omitempty"`
+}
+
+type WriteConsistencyError struct {
+	Consistency string               `json:"consistency"`
+	Written     int                  `json:"written"`
+	Circles     []*CircleWriteStatus `json:"circles"`
+}
+
+func (e *WriteConsistencyError) Error() string {
+	return fmt.Sprintf("write consistency not met: require %s, %d/%d circles written", e.Consistency, e.Written, len(e.Circles))
+}
+
+// WriteAck tracks the flushes of the batches which hold the points of one write request,
+// a backend is finished when it has been sealed by the flush marker and no flush is pending
+type WriteAck struct {
+	lock    sync.Mutex
+	wg      sync.WaitGroup
+	circles map[*Backend]*Circle
+	pending map[*Backend]int
+	sealed  map[*Backend]bool
+	results map[*Backend]error
+}
+
+func NewWriteAck() *WriteAck {
+	return &WriteAck{
+		circles: make(map[*Backend]*Circle),
+		pending: make(map[*Backend]int),
+		sealed:  make(map[*Backend]bool),
+		results: make(map[*Backend]error),
+	}
+}
+
+func (wa *WriteAck) touch(be *Backend, circle *Circle) {
+	wa.lock.Lock()
+	defer wa.lock.Unlock()
+	if _, ok := wa.circles[be]; !ok {
+		wa.circles[be] = circle
+		wa.wg.Add(1)
+	}
+}
+
+func (wa *WriteAck) backends() []*Backend {
+	wa.lock.Lock()
+	defer wa.lock.Unlock()
+	backends := make([]*Backend, 0, len(wa.circles))
+	for be := range wa.circles {
+		backends = append(backends, be)
+	}
+	return backends
+}
+
+func (wa *WriteAck) begin(be *Backend) {
+	wa.lock.Lock()
+	defer wa.lock.Unlock()
+	wa.pending[be]++
+}
+
+func (wa *WriteAck) done(be *Backend, err error) {
+	wa.lock.Lock()
+	defer wa.lock.Unlock()
+	wa.pending[be]--
+	wa.setResult(be, err)
+	if wa.sealed[be] && wa.pending[be] == 0 {
+		wa.wg.Done()
+	}
+}
+
+// fail records the error of a point refused by the backend, which is not flushed
+func (wa *WriteAck) fail(be *Backend, err error) {
+	wa.lock.Lock()
+	defer wa.lock.Unlock()
+	wa.setResult(be, err)
+}
+
+func (wa *WriteAck) setResult(be *Backend, err error) {
+	// keep the worst result: dropped > spooled > written
+	if prev := wa.results[be]; prev == nil || prev == ErrSpooled {
+		if err != nil {
+			wa.results[be] = err
+		}
+	}
+}
+
+func (wa *WriteAck) seal(be *Backend) {
+	wa.lock.Lock()
+	defer wa.lock.Unlock()
+	wa.sealed[be] = true
+	if wa.pending[be] == 0 {
+		wa.wg.Done()
+	}
+}
+
+func (wa *WriteAck) Wait() {
+	wa.wg.Wait()
+}
+
+func (wa *WriteAck) Check(circles []*Circle, consistency string) error {
+	wa.lock.Lock()
+	defer wa.lock.Unlock()
+	if len(wa.circles) == 0 {
+		return nil
+	}
+	statuses := make([]*CircleWriteStatus, len(circles))
+	index := make(map[*Circle]int, len(circles))
+	for i, circle := range circles {
+		statuses[i] = &CircleWriteStatus{Id: circle.CircleId, Name: circle.Name, Status: "ok"}
+		index[circle] = i
+	}
+	for be, circle := range wa.circles {
+		i, ok := index[circle]
+		if !ok {
+			// the circle is removed during the write
+			continue
+		}
+		status := statuses[i]
+		switch err := wa.results[be]; err {
+		case nil:
+		case ErrSpooled:
+			if status.Status == "ok" {
+				status.Status = "spooled"
+			}
+		default:
+			status.Status = "failed"
+			status.Err = fmt.Sprintf("%s: %s", be.Name, err)
+		}
+	}
+	written := 0
+	for _, status := range statuses {
+		if status.Status == "ok" {
+			written++
+		}
+	}
+	var required int
+	switch consistency {
+	case ConsistencyOne:
+		required = 1
+	case ConsistencyQuorum:
+		required = len(circles)/2 + 1
+	default:
+		required = len(circles)
+	}
+	if written >= required {
+		return nil
+	}
+	return &WriteConsistencyError{Consistency: consistency, Written: written, Circles: statuses}
+}
@@ -0,0 +1,76 @@
+package backend
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWriteAck(t *testing.T) {
+	circles := newTestCircles(3)
+	results := []error{nil, ErrSpooled, ErrBadRequest}
+
+	ack := NewWriteAck()
+	for _, circle := range circles {
+		ack.touch(circle.Backends[0], circle)
+		ack.touch(circle.Backends[0], circle)
+	}
+	for i, circle := range circles {
+		be := circle.Backends[0]
+		ack.begin(be)
+		ack.begin(be)
+		ack.done(be, nil)
+		ack.seal(be)
+		ack.done(be, results[i])
+	}
+	ack.Wait()
+
+	tests := []struct {
+		consistency string
+		want        bool
+	}{
+		{ConsistencyOne, true},
+		{ConsistencyQuorum, false},
+		{ConsistencyAll, false},
+	}
+	for _, tt := range tests {
+		err := ack.Check(circles, tt.consistency)
+		if (err == nil) != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.consistency, err, tt.want)
+		}
+	}
+
+	err := ack.Check(circles, ConsistencyAll).(*WriteConsistencyError)
+	status := []string{"ok", "spooled", "failed"}
+	for i, cs := range err.Circles {
+		if cs.Status != status[i] {
+			t.Errorf("circle %d: got %s, want %s", i, cs.Status, status[i])
+		}
+	}
+}
+
+func TestWriteAckEmpty(t *testing.T) {
+	ack := NewWriteAck()
+	ack.Wait()
+	if err := ack.Check(newTestCircles(2), ConsistencyAll); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+}
+
+func TestWriteAckClosedBackend(t *testing.T) {
+	cfg := newTestProxyConfig(t)
+	ip := NewProxy(cfg)
+	ip.Close(context.Background())
+
+	// the point refused by the closed backend fails the circle
+	ack := NewWriteAck()
+	if err := ip.WriteRow([]byte("cpu value=1"), "db", "", "ns", ack, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, be := range ack.backends() {
+		be.WritePoint(&LinePoint{Ack: ack})
+	}
+	ack.Wait()
+	if err := ack.Check(ip.Circles, ConsistencyAll); err == nil {
+		t.Error("write to a closed backend acknowledged")
+	}
+}
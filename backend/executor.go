@@ -1,55 +1,376 @@
 package backend
 
 import (
+	"context"
 	"fmt"
-	"math/rand"
+	"io"
+	"log"
 	"net/http"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/influxdata/influxdb1-client/models"
+	"github.com/influxdata/influxql"
 	"github.com/tixff/influx-proxy/util"
 )
 
-func QueryFromQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []string, db string) (body []byte, err error) {
+func QueryFromQL(w http.ResponseWriter, req *http.Request, ip *Proxy, stmt influxql.Statement, db string) (body []byte, err error) {
 	// available circle -> backend by key(db,meas) -> select or show
-	meas, err := GetMeasurementFromTokens(tokens)
-	if err != nil {
+	measurements := GetMeasurementsFromStatement(stmt)
+	if len(measurements) == 0 {
 		return nil, ErrGetMeasurement
 	}
-	key := GetKey(db, meas)
-	badSet := make(map[int]bool)
-	for {
-		if len(badSet) == len(ip.Circles) {
-			return nil, ErrBackendsUnavailable
+	var key string
+	var multiple, sharded bool
+	for _, m := range measurements {
+		mdb := db
+		if m.Database != "" {
+			mdb = m.Database
 		}
-		id := rand.Intn(len(ip.Circles))
-		if badSet[id] {
-			continue
+		mkey := GetKey(mdb, m.Name)
+		// regex, multiple or sharded measurements may live in more than one backend of a circle
+		if m.Regex != nil || (key != "" && mkey != key) {
+			multiple = true
 		}
+		if ip.ShardTags.IsSharded(mdb, m.Name) {
+			sharded = true
+		}
+		key = mkey
+	}
+	queryMode := ip.GetQueryMode()
+	if queryMode == QueryModeMerge || multiple || sharded {
+		sstmt, ok := stmt.(*influxql.SelectStatement)
+		if !ok {
+			return QueryShowQL(w, req, ip, stmt)
+		}
+		if queryMode != QueryModeMerge && !sharded && isExpandable(sstmt) {
+			return QueryExpandFromQL(w, req, ip, sstmt, db)
+		}
+		return QueryMergeFromQL(w, req, ip, sstmt)
+	}
+	if delay := ip.GetHedgeDelay(); delay > 0 && req.FormValue("chunked") != "true" {
+		return QueryHedged(w, req, ip, key, delay)
+	}
+	// a backend failed without response or with a server error is retried in the next circle
+	var last *QueryResult
+	for _, id := range ip.ReadOrder(key) {
 		circle := ip.Circles[id]
 		if circle.WriteOnly {
-			badSet[id] = true
 			continue
 		}
 		be := circle.GetBackend(key)
 		if be.IsActive() {
-			qr := be.Query(req, w, false)
-			if qr.Status > 0 || len(badSet) == len(ip.Circles)-1 {
-				return qr.Body, qr.Err
+			if req.FormValue("chunked") == "true" {
+				last = be.QueryStream(req, w)
+				if last.Streamed {
+					return nil, nil
+				}
+			} else {
+				last = be.Query(req, w, false)
+			}
+			if last.Status > 0 && last.Status < 500 {
+				return last.Body, last.Err
+			}
+		}
+	}
+	if last != nil {
+		return last.Body, last.Err
+	}
+	return nil, ErrBackendsUnavailable
+}
+
+type hedgedResult struct {
+	be *Backend
+	qr *QueryResult
+}
+
+// QueryHedged sends the query to the backend of key in the first circle of the read policy, and to the backend in the next circle
+// each time no response comes within the delay or the last one fails without response or with a server error,
+// the first response which is not a server error is returned and the other queries are canceled
+func QueryHedged(w http.ResponseWriter, req *http.Request, ip *Proxy, key string, delay time.Duration) (body []byte, err error) {
+	var backends []*Backend
+	for _, id := range ip.ReadOrder(key) {
+		circle := ip.Circles[id]
+		if circle.WriteOnly {
+			continue
+		}
+		if be := circle.GetBackend(key); be.IsActive() {
+			backends = append(backends, be)
+		}
+	}
+	if len(backends) == 0 {
+		return nil, ErrBackendsUnavailable
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	ch := make(chan *hedgedResult, len(backends))
+	var next int
+	var hedge <-chan time.Time
+	launch := func() {
+		be := backends[next]
+		cr := CloneQueryRequest(req.WithContext(ctx))
+		cr.Header.Set("Query-Origin", "Parallel")
+		go func() {
+			ch <- &hedgedResult{be, be.Query(cr, nil, false)}
+		}()
+		next++
+		hedge = nil
+		if next < len(backends) {
+			hedge = time.After(delay)
+		}
+	}
+
+	launch()
+	var last *QueryResult
+	for pending := 1; pending > 0; {
+		select {
+		case hr := <-ch:
+			pending--
+			if hr.qr.Status > 0 && hr.qr.Status < 500 {
+				if next > 1 {
+					QueryHedges.WithLabelValues(hr.be.Name).Inc()
+				}
+				CopyHeader(w.Header(), hr.qr.Header)
+				return hr.qr.Body, hr.qr.Err
+			}
+			last = hr.qr
+			if next < len(backends) {
+				launch()
+				pending++
+			}
+		case <-hedge:
+			launch()
+			pending++
+		}
+	}
+	CopyHeader(w.Header(), last.Header)
+	return last.Body, last.Err
+}
+
+func getQueryCircle(ip *Proxy) *Circle {
+	for _, id := range ip.ReadOrder("") {
+		c := ip.Circles[id]
+		if !c.WriteOnly && c.IsActive() {
+			return c
+		}
+	}
+	return nil
+}
+
+func isExpandable(stmt *influxql.SelectStatement) bool {
+	for _, source := range stmt.Sources {
+		if _, ok := source.(*influxql.Measurement); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// unavailableError returns the error of a result missing the data of the inactive backends
+func unavailableError(inactive, responded int) string {
+	return fmt.Sprintf("%d/%d backends unavailable", inactive, inactive+responded)
+}
+
+// ExpandMeasurements expands the regex measurements by the measurements shown on all backends of the circle,
+// inactive is the number of backends not shown whose measurements are missing
+func ExpandMeasurements(req *http.Request, circle *Circle, sources influxql.Sources, db string) (measurements []*influxql.Measurement, inactive int, err error) {
+	nameSet := make(map[string]bool)
+	add := func(m *influxql.Measurement) {
+		name := m.Database + "." + m.RetentionPolicy + "." + m.Name
+		if !nameSet[name] {
+			nameSet[name] = true
+			measurements = append(measurements, m)
+		}
+	}
+	for _, source := range sources {
+		m := source.(*influxql.Measurement)
+		if m.Regex == nil {
+			add(m)
+			continue
+		}
+		mdb := db
+		if m.Database != "" {
+			mdb = m.Database
+		}
+		show := &influxql.ShowMeasurementsStatement{Source: &influxql.Measurement{Regex: m.Regex}}
+		cr := CloneQueryRequest(req)
+		cr.Form.Set("db", mdb)
+		cr.Form.Set("q", show.String())
+		cr.Form.Del("params")
+		cr.Form.Del("chunked")
+		bodies, n, err := QueryInParallel(circle.Backends, cr, nil, true)
+		if err != nil {
+			return nil, 0, err
+		}
+		if n > inactive {
+			inactive = n
+		}
+		var names []string
+		for _, b := range bodies {
+			series, err := SeriesFromResponseBytes(b)
+			if err != nil {
+				return nil, 0, err
+			}
+			for _, serie := range series {
+				for _, value := range serie.Values {
+					if name, ok := value[0].(string); ok {
+						names = append(names, name)
+					}
+				}
 			}
 		}
-		badSet[id] = true
+		sort.Strings(names)
+		for _, name := range names {
+			add(&influxql.Measurement{Database: m.Database, RetentionPolicy: m.RetentionPolicy, Name: name})
+		}
 	}
+	return
 }
 
-func QueryShowQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []string) (body []byte, err error) {
+func QueryExpandFromQL(w http.ResponseWriter, req *http.Request, ip *Proxy, stmt *influxql.SelectStatement, db string) (body []byte, err error) {
+	// available circle -> show measurements to expand regex -> backends by key(db,meas) -> select, then merge series
+	circle := getQueryCircle(ip)
+	if circle == nil {
+		return nil, ErrBackendsUnavailable
+	}
+	chunked := req.FormValue("chunked") == "true"
+	measurements, inactive, err := ExpandMeasurements(req, circle, stmt.Sources, db)
+	if err != nil {
+		return
+	}
+	var backends []*Backend
+	sourcesMap := make(map[*Backend]influxql.Sources)
+	for _, m := range measurements {
+		mdb := db
+		if m.Database != "" {
+			mdb = m.Database
+		}
+		if ip.ShardTags.IsSharded(mdb, m.Name) {
+			return QueryMergeFromQL(w, req, ip, stmt)
+		}
+		be := circle.GetBackend(GetKey(mdb, m.Name))
+		if _, ok := sourcesMap[be]; !ok {
+			backends = append(backends, be)
+		}
+		sourcesMap[be] = append(sourcesMap[be], m)
+	}
+
+	rstmt, opts := RewriteSelectForMerge(stmt)
+	var wg sync.WaitGroup
+	ch := make(chan *QueryResult, len(backends))
+	for _, be := range backends {
+		bstmt := rstmt.Clone()
+		bstmt.Sources = sourcesMap[be]
+		cr := CloneQueryRequest(req)
+		cr.Form.Set("q", bstmt.String())
+		cr.Form.Del("params")
+		cr.Form.Del("chunked")
+		cr.Header.Set("Query-Origin", "Parallel")
+		wg.Add(1)
+		go func(be *Backend, cr *http.Request) {
+			defer wg.Done()
+			ch <- be.Query(cr, nil, true)
+		}(be, cr)
+	}
+	wg.Wait()
+	close(ch)
+	var bodies [][]byte
+	for qr := range ch {
+		if qr.Err != nil {
+			return nil, qr.Err
+		}
+		CopyHeader(w.Header(), qr.Header)
+		bodies = append(bodies, qr.Body)
+	}
+	w.Header().Del("Content-Length")
+	rsp, err := mergeByTags(bodies, opts.Desc)
+	if err != nil {
+		return
+	}
+	opts.Apply(rsp)
+	if inactive > 0 {
+		rsp.Err = unavailableError(inactive, len(circle.Backends)-inactive)
+	}
+	return marshalResponse(w, req, rsp, chunked)
+}
+
+func QueryMergeFromQL(w http.ResponseWriter, req *http.Request, ip *Proxy, stmt *influxql.SelectStatement) (body []byte, err error) {
+	// available circle -> all backends -> select, then merge series by tags and time, or combine partial aggregates
+	circle := getQueryCircle(ip)
+	if circle == nil {
+		return nil, ErrBackendsUnavailable
+	}
+	chunked := req.FormValue("chunked") == "true"
+
+	var rstmt *influxql.SelectStatement
+	var opts *MergeOptions
+	var agg *Aggregator
+	if stmt.IsRawQuery {
+		rstmt, opts = RewriteSelectForMerge(stmt)
+	} else {
+		rstmt, agg, err = RewriteSelectForAggregate(stmt)
+		if err != nil {
+			return
+		}
+		opts = agg.MergeOptions
+	}
+	cr := CloneQueryRequest(req)
+	cr.Form.Set("q", rstmt.String())
+	cr.Form.Del("params")
+	cr.Form.Del("chunked")
+	bodies, inactive, err := QueryInParallel(circle.Backends, cr, w, true)
+	if err != nil {
+		return
+	}
+	if inactive > 0 && len(bodies) == 0 {
+		return nil, ErrBackendsUnavailable
+	}
+	var rsp *Response
+	if agg != nil {
+		rsp, err = agg.Combine(bodies)
+	} else {
+		rsp, err = mergeByTags(bodies, opts.Desc)
+	}
+	if err != nil {
+		return
+	}
+	opts.Apply(rsp)
+	if inactive > 0 {
+		rsp.Err = unavailableError(inactive, len(bodies))
+	}
+	return marshalResponse(w, req, rsp, chunked)
+}
+
+func QueryShowQL(w http.ResponseWriter, req *http.Request, ip *Proxy, stmt influxql.Statement) (body []byte, err error) {
 	// all circles -> all backends -> show
-	// remove support of query parameter `chunked`
+	// the backends respond unchunked, since the responses are reduced, and then chunked by the proxy
+	chunked := req.FormValue("chunked") == "true"
 	req.Form.Del("chunked")
 	backends := make([]*Backend, 0)
 	for _, circle := range ip.Circles {
 		backends = append(backends, circle.Backends...)
 	}
+
+	reduce, dedup := func([][]byte) (*Response, error) { return nil, nil }, false
+	switch stmt.(type) {
+	case *influxql.ShowMeasurementsStatement, *influxql.ShowSeriesStatement:
+		reduce, dedup = reduceByValues, true
+	case *influxql.ShowDatabasesStatement:
+		reduce, dedup = reduceDatabases(ip.user), true
+	case *influxql.ShowFieldKeysStatement, *influxql.ShowTagKeysStatement, *influxql.ShowTagValuesStatement:
+		reduce, dedup = reduceBySeries, true
+	case *influxql.ShowRetentionPoliciesStatement:
+		reduce = concatByValues
+	case *influxql.ShowStatsStatement:
+		reduce = concatByResults
+	}
+	if chunked {
+		return streamShowQL(w, req, backends, reduce, dedup)
+	}
+
 	bodies, inactive, err := QueryInParallel(backends, req, w, true)
 	if err != nil {
 		return
@@ -57,19 +378,7 @@ func QueryShowQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []s
 	if inactive > 0 && len(bodies) == 0 {
 		return nil, ErrBackendsUnavailable
 	}
-
-	var rsp *Response
-	stmt2 := GetHeadStmtFromTokens(tokens, 2)
-	stmt3 := GetHeadStmtFromTokens(tokens, 3)
-	if stmt2 == "show measurements" || stmt2 == "show series" || stmt2 == "show databases" {
-		rsp, err = reduceByValues(bodies)
-	} else if stmt3 == "show field keys" || stmt3 == "show tag keys" || stmt3 == "show tag values" {
-		rsp, err = reduceBySeries(bodies)
-	} else if stmt3 == "show retention policies" {
-		rsp, err = concatByValues(bodies)
-	} else if stmt2 == "show stats" {
-		rsp, err = concatByResults(bodies)
-	}
+	rsp, err := reduce(bodies)
 	if err != nil {
 		return
 	}
@@ -77,9 +386,131 @@ func QueryShowQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []s
 		rsp = ResponseFromSeries(nil)
 	}
 	if inactive > 0 {
-		rsp.Err = fmt.Sprintf("%d/%d backends unavailable", inactive, inactive+len(bodies))
+		rsp.Err = unavailableError(inactive, len(bodies))
 	}
+	return marshalResponse(w, req, rsp, chunked)
+}
+
+// streamShowQL writes the reduced result of each backend as chunks once the backend responds, the values
+// written before are skipped when dedup, the chunks are partial and the result ends with an empty chunk
+func streamShowQL(w http.ResponseWriter, req *http.Request, backends []*Backend, reduce func([][]byte) (*Response, error), dedup bool) (body []byte, err error) {
+	chunkSize, _ := strconv.Atoi(req.FormValue("chunk_size"))
 	pretty := req.URL.Query().Get("pretty") == "true"
+	ch, inactive := queryInParallel(backends, req, true)
+
+	var fw io.Writer
+	write := func(rsp *Response) bool {
+		if fw == nil {
+			w.Header().Del("Content-Encoding")
+			w.Header().Del("Content-Length")
+			w.Header().Set("X-Influxdb-Version", Version)
+			w.WriteHeader(200)
+			fw = newFlushWriter(w)
+		}
+		if _, err := fw.Write(util.MarshalJSON(rsp, pretty)); err != nil {
+			log.Printf("write chunk error: %s", err)
+			return false
+		}
+		return true
+	}
+
+	seen := make(map[string]bool)
+	responded := 0
+	for qr := range ch {
+		var rsp *Response
+		if qr.Err == nil {
+			rsp, qr.Err = reduce([][]byte{qr.Body})
+		}
+		if qr.Err != nil {
+			if fw == nil {
+				return nil, qr.Err
+			}
+			write(ResponseFromError(qr.Err.Error()))
+			return nil, nil
+		}
+		if fw == nil {
+			CopyHeader(w.Header(), qr.Header)
+		}
+		responded++
+		if rsp == nil {
+			continue
+		}
+		if dedup {
+			skipValues(rsp, seen)
+		}
+		if !hasSeries(rsp) {
+			continue
+		}
+		for _, chunk := range rsp.Chunks(chunkSize) {
+			for _, r := range chunk.Results {
+				r.Partial = true
+			}
+			if !write(chunk) {
+				return nil, nil
+			}
+		}
+	}
+	if inactive > 0 && responded == 0 {
+		return nil, ErrBackendsUnavailable
+	}
+	last := ResponseFromSeries(nil)
+	if inactive > 0 {
+		last.Err = unavailableError(inactive, responded)
+	}
+	write(last)
+	return nil, nil
+}
+
+// skipValues removes the values of the series in seen from rsp, and adds the others to seen
+func skipValues(rsp *Response, seen map[string]bool) {
+	for _, r := range rsp.Results {
+		var series models.Rows
+		for _, serie := range r.Series {
+			values := serie.Values[:0]
+			for _, value := range serie.Values {
+				key := serie.Name + "\x00" + fmt.Sprint(value)
+				if !seen[key] {
+					seen[key] = true
+					values = append(values, value)
+				}
+			}
+			if len(values) > 0 {
+				serie.Values = values
+				series = append(series, serie)
+			}
+		}
+		r.Series = series
+	}
+}
+
+func hasSeries(rsp *Response) bool {
+	for _, r := range rsp.Results {
+		if len(r.Series) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// marshalResponse returns the marshaled response, or writes the chunks of the response to the client when chunked,
+// in which case the body is nil since the response has been written
+func marshalResponse(w http.ResponseWriter, req *http.Request, rsp *Response, chunked bool) (body []byte, err error) {
+	pretty := req.URL.Query().Get("pretty") == "true"
+	if chunked {
+		chunkSize, _ := strconv.Atoi(req.FormValue("chunk_size"))
+		w.Header().Del("Content-Encoding")
+		w.Header().Del("Content-Length")
+		w.Header().Set("X-Influxdb-Version", Version)
+		w.WriteHeader(200)
+		fw := newFlushWriter(w)
+		for _, chunk := range rsp.Chunks(chunkSize) {
+			if _, err = fw.Write(util.MarshalJSON(chunk, pretty)); err != nil {
+				log.Printf("write chunk error: %s", err)
+				break
+			}
+		}
+		return nil, nil
+	}
 	body = util.MarshalJSON(rsp, pretty)
 	if w.Header().Get("Content-Encoding") == "gzip" {
 		return util.GzipCompress(body)
@@ -87,14 +518,33 @@ func QueryShowQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []s
 	return
 }
 
-func QueryDeleteOrDropQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []string, db string) (body []byte, err error) {
+func QueryDeleteOrDropQL(w http.ResponseWriter, req *http.Request, ip *Proxy, stmt influxql.Statement, db string) (body []byte, err error) {
 	// all circles -> backend by key(db,meas) -> delete or drop
-	meas, err := GetMeasurementFromTokens(tokens)
-	if err != nil {
-		return nil, err
+	measurements := GetMeasurementsFromStatement(stmt)
+	if len(measurements) == 0 {
+		return nil, ErrGetMeasurement
+	}
+	var backends []*Backend
+	backendSet := make(map[*Backend]bool)
+	for _, m := range measurements {
+		mdb := db
+		if m.Database != "" {
+			mdb = m.Database
+		}
+		if m.Regex != nil || ip.ShardTags.IsSharded(mdb, m.Name) {
+			backends = backends[:0]
+			for _, circle := range ip.Circles {
+				backends = append(backends, circle.Backends...)
+			}
+			break
+		}
+		for _, be := range ip.GetBackends(GetKey(mdb, m.Name)) {
+			if !backendSet[be] {
+				backendSet[be] = true
+				backends = append(backends, be)
+			}
+		}
 	}
-	key := GetKey(db, meas)
-	backends := ip.GetBackends(key)
 	if len(backends) == 0 {
 		return nil, ErrGetBackends
 	}
@@ -129,8 +579,28 @@ func QueryAlterQL(w http.ResponseWriter, req *http.Request, ip *Proxy) (body []b
 }
 
 func QueryInParallel(backends []*Backend, req *http.Request, w http.ResponseWriter, decompress bool) (bodies [][]byte, inactive int, err error) {
-	var wg sync.WaitGroup
 	var header http.Header
+	ch, inactive := queryInParallel(backends, req, decompress)
+	for qr := range ch {
+		if qr.Err != nil {
+			err = qr.Err
+			return
+		}
+		header = qr.Header
+		bodies = append(bodies, qr.Body)
+	}
+	if w != nil {
+		CopyHeader(w.Header(), header)
+		w.Header().Del("Content-Length")
+	}
+	return
+}
+
+// queryInParallel sends the query to the active backends, the results are sent to the channel once they respond,
+// which is closed after all responded
+func queryInParallel(backends []*Backend, req *http.Request, decompress bool) (<-chan *QueryResult, int) {
+	var wg sync.WaitGroup
+	var inactive int
 	req.Header.Set("Query-Origin", "Parallel")
 	ch := make(chan *QueryResult, len(backends))
 	for _, be := range backends {
@@ -149,18 +619,7 @@ func QueryInParallel(backends []*Backend, req *http.Request, w http.ResponseWrit
 		wg.Wait()
 		close(ch)
 	}()
-	for qr := range ch {
-		if qr.Err != nil {
-			err = qr.Err
-			return
-		}
-		header = qr.Header
-		bodies = append(bodies, qr.Body)
-	}
-	if w != nil {
-		CopyHeader(w.Header(), header)
-	}
-	return
+	return ch, inactive
 }
 
 func reduceByValues(bodies [][]byte) (rsp *Response, err error) {
@@ -193,6 +652,33 @@ func reduceByValues(bodies [][]byte) (rsp *Response, err error) {
 	return ResponseFromSeries(series), nil
 }
 
+// reduceDatabases returns a reduce of the databases which removes the databases the user can not read
+func reduceDatabases(user *User) func([][]byte) (*Response, error) {
+	return func(bodies [][]byte) (rsp *Response, err error) {
+		rsp, err = reduceByValues(bodies)
+		if err != nil || user == nil || user.Admin {
+			return
+		}
+		for _, r := range rsp.Results {
+			var series models.Rows
+			for _, serie := range r.Series {
+				values := serie.Values[:0]
+				for _, value := range serie.Values {
+					if db, ok := value[0].(string); ok && user.AuthorizeDB(db, influxql.ReadPrivilege) == nil {
+						values = append(values, value)
+					}
+				}
+				if len(values) > 0 {
+					serie.Values = values
+					series = append(series, serie)
+				}
+			}
+			r.Series = series
+		}
+		return
+	}
+}
+
 func reduceBySeries(bodies [][]byte) (rsp *Response, err error) {
 	var series models.Rows
 	seriesMap := make(map[string]*models.Row)
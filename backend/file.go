@@ -1,53 +1,385 @@
 package backend
 
 import (
+	"bufio"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
+const (
+	SpoolPolicyDropOldest = "drop-oldest"
+	SpoolPolicyRejectNew  = "reject-new"
+)
+
+// a record has a header of magic, data length, unix nano timestamp and crc32 of the fields and data before the data
+const (
+	recordMagic      = 0x49505852
+	recordHeaderSize = 20
+)
+
+var (
+	ErrSpoolFull       = errors.New("spool is full")
+	errCorruptedRecord = errors.New("corrupted record")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type spoolSegment struct {
+	seq     int64
+	size    int64
+	records int64
+	modTime time.Time
+}
+
+// SpoolStats is the backlog of a spool, Segment and Offset are the consumer position kept in the meta
+type SpoolStats struct {
+	Bytes    int64      `json:"bytes"`
+	Records  int64      `json:"records"`
+	Segments int        `json:"segments"`
+	Segment  int64      `json:"segment"`
+	Offset   int64      `json:"offset"`
+	Oldest   *time.Time `json:"oldest,omitempty"`
+}
+
+// FileBackend spools data to rotating segment files, the consumer reads from the first segment
+// and the producer appends to the last one, a segment is deleted once fully consumed
 type FileBackend struct {
-	lock     sync.Mutex
-	filename string
-	datadir  string
-	dataflag bool
-	producer *os.File
-	consumer *os.File
-	meta     *os.File
+	lock        sync.Mutex
+	filename    string
+	datadir     string
+	size        int64
+	offset      int64
+	segments    []*spoolSegment
+	producer    *os.File
+	consumer    *os.File
+	meta        *os.File
+	segmentSize int64
+	maxSize     int64
+	maxAge      time.Duration
+	policy      string
+	// batch is the sizes of the records read from batchOffset of the segment batchSeq and not consumed yet
+	batch       []int64
+	batchSeq    int64
+	batchOffset int64
 }
 
-func NewFileBackend(filename string, datadir string) (fb *FileBackend, err error) {
+func NewFileBackend(filename string, datadir string, pxcfg *ProxyConfig) (fb *FileBackend, err error) {
 	fb = &FileBackend{
-		filename: filename,
-		datadir:  datadir,
+		filename:    filename,
+		datadir:     datadir,
+		segmentSize: int64(pxcfg.SpoolSegmentSize),
+		maxSize:     int64(pxcfg.SpoolMaxSize),
+		maxAge:      time.Duration(pxcfg.SpoolMaxAge) * time.Second,
+		policy:      pxcfg.SpoolPolicy,
 	}
 
 	pathname := filepath.Join(datadir, filename)
-	fb.producer, err = os.OpenFile(pathname+".dat", os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	legacy, err := fb.loadSegments()
+	if err != nil {
+		log.Printf("load segments error: %s %s", fb.filename, err)
+		return
+	}
+
+	fb.meta, err = os.OpenFile(pathname+".rec", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		log.Printf("open meta error: %s %s", fb.filename, err)
+		return
+	}
+	seq, offset := fb.readMeta()
+	// the segments before the one in meta were consumed before a crash
+	for len(fb.segments) > 1 && fb.segments[0].seq < seq {
+		os.Remove(fb.segmentPath(fb.segments[0].seq))
+		fb.size -= fb.segments[0].size
+		fb.segments = fb.segments[1:]
+	}
+	if seq != 0 && fb.segments[0].seq != seq || offset > fb.segments[0].size {
+		offset = 0
+	}
+	fb.scan(offset)
+
+	fb.producer, err = os.OpenFile(fb.segmentPath(fb.lastSegment().seq), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
 		log.Printf("open producer error: %s %s", fb.filename, err)
 		return
 	}
+	err = fb.openConsumer(offset)
+	if err != nil {
+		return
+	}
+	if legacy {
+		err = fb.migrate(fb.readLegacyOffset())
+		if err != nil {
+			log.Printf("migrate data file error: %s %s", fb.filename, err)
+			return
+		}
+	}
+	fb.updatePending()
+	return
+}
+
+func (fb *FileBackend) segmentPath(seq int64) string {
+	return filepath.Join(fb.datadir, fmt.Sprintf("%s.dat.%016d", fb.filename, seq))
+}
+
+// loadSegments lists the segment files, legacy is true if there is a data file of version <= 2.5 to migrate
+func (fb *FileBackend) loadSegments() (legacy bool, err error) {
+	files, err := ioutil.ReadDir(fb.datadir)
+	if err != nil {
+		return
+	}
+	prefix := fb.filename + ".dat."
+	for _, fi := range files {
+		if !strings.HasPrefix(fi.Name(), prefix) {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimPrefix(fi.Name(), prefix), 10, 64)
+		if err != nil || seq <= 0 {
+			continue
+		}
+		fb.segments = append(fb.segments, &spoolSegment{seq: seq, size: fi.Size(), modTime: fi.ModTime()})
+		fb.size += fi.Size()
+	}
+	sort.Slice(fb.segments, func(i, j int) bool { return fb.segments[i].seq < fb.segments[j].seq })
+
+	if len(fb.segments) == 0 {
+		_, err = os.Stat(fb.legacyPath())
+		legacy, err = err == nil, nil
+		fb.segments = append(fb.segments, &spoolSegment{seq: 1, modTime: time.Now()})
+	}
+	return
+}
+
+func (fb *FileBackend) legacyPath() string {
+	return filepath.Join(fb.datadir, fb.filename+".dat")
+}
+
+// readLegacyOffset returns the consumer offset of the data file of version <= 2.5
+func (fb *FileBackend) readLegacyOffset() (offset int64) {
+	var buf [16]byte
+	n, _ := fb.meta.ReadAt(buf[:], 0)
+	if n == 8 {
+		offset = int64(binary.BigEndian.Uint64(buf[:8]))
+	}
+	return
+}
+
+// migrate rewrites the records of the data file of version <= 2.5 with header into the segments
+func (fb *FileBackend) migrate(offset int64) (err error) {
+	f, err := os.Open(fb.legacyPath())
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return
+	}
+
+	var count int
+	r := bufio.NewReader(f)
+	for pos := offset; pos < fi.Size(); {
+		var length uint32
+		err = binary.Read(r, binary.BigEndian, &length)
+		if err == nil && int64(length) > fi.Size()-pos-4 {
+			err = errCorruptedRecord
+		}
+		if err != nil {
+			b := make([]byte, fi.Size()-pos)
+			f.ReadAt(b, pos)
+			fb.quarantine(b)
+			break
+		}
+		p := make([]byte, length)
+		_, err = io.ReadFull(r, p)
+		if err != nil {
+			return
+		}
+		err = fb.Write(p)
+		if err != nil && err != ErrSpoolFull {
+			return
+		}
+		pos += 4 + int64(length)
+		count++
+	}
+	log.Printf("spool migrate: %s, records: %d", fb.filename, count)
+	err = fb.writeMeta()
+	if err != nil {
+		return
+	}
+	f.Close()
+	return os.Remove(fb.legacyPath())
+}
+
+// scan checks the records not consumed yet and reports how many are recovered, a torn record at the end
+// of the last segment left by a crash is quarantined and truncated, the others are skipped by the reader
+func (fb *FileBackend) scan(offset int64) {
+	if fb.size <= offset {
+		return
+	}
+	var records, corrupted int64
+	for i, seg := range fb.segments {
+		path := fb.segmentPath(seg.seq)
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Printf("scan segment error: %s %s", path, err)
+			continue
+		}
+		pos := 0
+		if i == 0 {
+			pos = int(offset)
+		}
+		for pos < len(b) {
+			if _, _, n := decodeRecord(b[pos:]); n > 0 {
+				seg.records++
+				records++
+				pos += n
+				continue
+			}
+			n := 1 + nextRecord(b[pos+1:])
+			if pos+n == len(b) && i == len(fb.segments)-1 {
+				fb.quarantine(b[pos:])
+				err = os.Truncate(path, int64(pos))
+				if err != nil {
+					log.Printf("truncate segment error: %s %s", path, err)
+					break
+				}
+				fb.size -= seg.size - int64(pos)
+				seg.size = int64(pos)
+			} else {
+				corrupted += int64(n)
+			}
+			pos += n
+		}
+	}
+	log.Printf("spool scan: %s, records recovered: %d, corrupted bytes: %d", fb.filename, records, corrupted)
+}
+
+// quarantine appends the corrupted data to the .bad file for inspection
+func (fb *FileBackend) quarantine(p []byte) {
+	log.Printf("spool quarantine corrupted data: %s, length: %d", fb.filename, len(p))
+	fb.batch = nil
+	SpoolDroppedBytes.WithLabelValues(fb.filename, "corrupted").Add(float64(len(p)))
+	f, err := os.OpenFile(filepath.Join(fb.datadir, fb.filename+".bad"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Printf("open quarantine error: %s %s", fb.filename, err)
+		return
+	}
+	defer f.Close()
+	_, err = f.Write(p)
+	if err != nil {
+		log.Printf("write quarantine error: %s %s", fb.filename, err)
+	}
+}
+
+func encodeRecord(p []byte, ts int64) []byte {
+	b := make([]byte, recordHeaderSize+len(p))
+	binary.BigEndian.PutUint32(b[0:4], recordMagic)
+	binary.BigEndian.PutUint32(b[4:8], uint32(len(p)))
+	binary.BigEndian.PutUint64(b[8:16], uint64(ts))
+	copy(b[recordHeaderSize:], p)
+	crc := crc32.Update(crc32.Checksum(b[4:16], crcTable), crcTable, p)
+	binary.BigEndian.PutUint32(b[16:20], crc)
+	return b
+}
+
+// decodeRecord parses the record at the start of b, n is 0 if it is not a valid record
+func decodeRecord(b []byte) (p []byte, ts int64, n int) {
+	if len(b) < recordHeaderSize || binary.BigEndian.Uint32(b[0:4]) != recordMagic {
+		return
+	}
+	length := binary.BigEndian.Uint32(b[4:8])
+	if uint64(length) > uint64(len(b)-recordHeaderSize) {
+		return
+	}
+	p = b[recordHeaderSize : recordHeaderSize+int(length)]
+	crc := crc32.Update(crc32.Checksum(b[4:16], crcTable), crcTable, p)
+	if crc != binary.BigEndian.Uint32(b[16:20]) {
+		return nil, 0, 0
+	}
+	return p, int64(binary.BigEndian.Uint64(b[8:16])), recordHeaderSize + int(length)
+}
+
+// nextRecord returns the position of the first valid record in b, or len(b) if there is none
+func nextRecord(b []byte) int {
+	for i := 0; i+recordHeaderSize <= len(b); i++ {
+		if _, _, n := decodeRecord(b[i:]); n > 0 {
+			return i
+		}
+	}
+	return len(b)
+}
 
-	fb.consumer, err = os.OpenFile(pathname+".dat", os.O_RDONLY, 0644)
+func (fb *FileBackend) lastSegment() *spoolSegment {
+	return fb.segments[len(fb.segments)-1]
+}
+
+func (fb *FileBackend) openConsumer(offset int64) (err error) {
+	if fb.consumer != nil {
+		fb.consumer.Close()
+	}
+	fb.consumer, err = os.OpenFile(fb.segmentPath(fb.segments[0].seq), os.O_RDONLY|os.O_CREATE, 0644)
 	if err != nil {
 		log.Printf("open consumer error: %s %s", fb.filename, err)
 		return
 	}
+	_, err = fb.consumer.Seek(offset, io.SeekStart)
+	if err != nil {
+		log.Printf("seek consumer error: %s %s", fb.filename, err)
+		return
+	}
+	fb.offset = offset
+	return
+}
+
+// readMeta returns the segment and offset of the consumer, the meta of version <= 2.5 only has the offset
+func (fb *FileBackend) readMeta() (seq, offset int64) {
+	var buf [16]byte
+	n, _ := fb.meta.ReadAt(buf[:], 0)
+	switch {
+	case n >= 16:
+		seq = int64(binary.BigEndian.Uint64(buf[:8]))
+		offset = int64(binary.BigEndian.Uint64(buf[8:]))
+	case n >= 8:
+		offset = int64(binary.BigEndian.Uint64(buf[:8]))
+	}
+	return
+}
+
+func (fb *FileBackend) writeMeta() (err error) {
+	_, err = fb.meta.Seek(0, io.SeekStart)
+	if err != nil {
+		log.Printf("seek meta error: %s %s", fb.filename, err)
+		return
+	}
 
-	fb.meta, err = os.OpenFile(pathname+".rec", os.O_RDWR|os.O_CREATE, 0644)
+	log.Printf("write meta: %s, %d, %d", fb.filename, fb.segments[0].seq, fb.offset)
+	err = binary.Write(fb.meta, binary.BigEndian, [2]int64{fb.segments[0].seq, fb.offset})
 	if err != nil {
-		log.Printf("open meta error: %s %s", fb.filename, err)
+		log.Printf("write meta error: %s %s", fb.filename, err)
 		return
 	}
 
-	fb.RollbackMeta()
-	producerOffset, _ := fb.producer.Seek(0, io.SeekEnd)
-	offset, _ := fb.consumer.Seek(0, io.SeekCurrent)
-	fb.dataflag = producerOffset > offset
+	err = fb.meta.Sync()
+	if err != nil {
+		log.Printf("sync meta error: %s %s", fb.filename, err)
+		return
+	}
 	return
 }
 
@@ -55,19 +387,35 @@ func (fb *FileBackend) Write(p []byte) (err error) {
 	fb.lock.Lock()
 	defer fb.lock.Unlock()
 
-	var length = uint32(len(p))
-	err = binary.Write(fb.producer, binary.BigEndian, length)
-	if err != nil {
-		log.Print("write length error: ", err)
-		return
+	fb.expire()
+	length := int64(recordHeaderSize + len(p))
+	if fb.maxSize > 0 && fb.size+length > fb.maxSize {
+		if fb.policy == SpoolPolicyRejectNew || length > fb.maxSize {
+			log.Printf("spool full, reject data: %s, length: %d", fb.filename, length)
+			SpoolDroppedBytes.WithLabelValues(fb.filename, "rejected").Add(float64(length))
+			return ErrSpoolFull
+		}
+		for fb.size+length > fb.maxSize {
+			err = fb.dropSegment("oldest")
+			if err != nil {
+				return
+			}
+		}
+	}
+	if fb.segmentSize > 0 && fb.lastSegment().size > 0 && fb.lastSegment().size+length > fb.segmentSize {
+		err = fb.rotate()
+		if err != nil {
+			return
+		}
 	}
 
-	n, err := fb.producer.Write(p)
+	b := encodeRecord(p, time.Now().UnixNano())
+	n, err := fb.producer.Write(b)
 	if err != nil {
 		log.Print("write error: ", err)
 		return
 	}
-	if n != len(p) {
+	if n != len(b) {
 		return io.ErrShortWrite
 	}
 
@@ -77,57 +425,227 @@ func (fb *FileBackend) Write(p []byte) (err error) {
 		return
 	}
 
-	fb.dataflag = true
+	seg := fb.lastSegment()
+	seg.size += length
+	seg.records++
+	seg.modTime = time.Now()
+	fb.size += length
+	SpoolBytes.WithLabelValues(fb.filename).Add(float64(length))
+	fb.updatePending()
 	return
 }
 
-func (fb *FileBackend) IsData() bool {
-	fb.lock.Lock()
-	defer fb.lock.Unlock()
-	return fb.dataflag
+// rotate starts a new segment for the producer
+func (fb *FileBackend) rotate() (err error) {
+	seq := fb.lastSegment().seq + 1
+	producer, err := os.OpenFile(fb.segmentPath(seq), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Printf("open producer error: %s %s", fb.filename, err)
+		return
+	}
+	fb.producer.Close()
+	fb.producer = producer
+	fb.segments = append(fb.segments, &spoolSegment{seq: seq, modTime: time.Now()})
+	return
 }
 
-func (fb *FileBackend) Read() (p []byte, err error) {
-	if !fb.IsData() {
-		return nil, nil
+// removeSegment deletes the first segment and moves the consumer to the next one
+func (fb *FileBackend) removeSegment() (err error) {
+	if len(fb.segments) == 1 {
+		err = fb.rotate()
+		if err != nil {
+			return
+		}
 	}
-	var length uint32
-
-	err = binary.Read(fb.consumer, binary.BigEndian, &length)
+	seg := fb.segments[0]
+	fb.segments = fb.segments[1:]
+	fb.size -= seg.size
+	fb.batch = nil
+	err = fb.openConsumer(0)
+	if err != nil {
+		return
+	}
+	err = fb.writeMeta()
 	if err != nil {
-		log.Print("read length error: ", err)
 		return
 	}
-	p = make([]byte, length)
+	err = os.Remove(fb.segmentPath(seg.seq))
+	if err != nil {
+		log.Printf("remove segment error: %s %s", fb.filename, err)
+	}
+	fb.updatePending()
+	return nil
+}
 
-	_, err = io.ReadFull(fb.consumer, p)
+// dropSegment deletes the first segment with the data not consumed yet
+func (fb *FileBackend) dropSegment(reason string) (err error) {
+	seq, dropped := fb.segments[0].seq, fb.segments[0].size-fb.offset
+	err = fb.removeSegment()
 	if err != nil {
-		log.Print("read error: ", err)
 		return
 	}
+	log.Printf("spool drop segment: %s, seq: %d, length: %d, reason: %s", fb.filename, seq, dropped, reason)
+	SpoolDroppedBytes.WithLabelValues(fb.filename, reason).Add(float64(dropped))
 	return
 }
 
-func (fb *FileBackend) RollbackMeta() (err error) {
+// expire drops the segments whose latest data is older than max age
+func (fb *FileBackend) expire() {
+	if fb.maxAge <= 0 {
+		return
+	}
+	for {
+		seg := fb.segments[0]
+		var err error
+		if len(fb.segments) > 1 && fb.offset >= seg.size {
+			err = fb.removeSegment()
+		} else if seg.size > fb.offset && time.Since(seg.modTime) > fb.maxAge {
+			err = fb.dropSegment("expired")
+		} else {
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (fb *FileBackend) updatePending() {
+	SpoolPendingBytes.WithLabelValues(fb.filename).Set(float64(fb.size - fb.offset))
+}
+
+func (fb *FileBackend) IsData() bool {
 	fb.lock.Lock()
 	defer fb.lock.Unlock()
+	return fb.size > fb.offset
+}
 
-	_, err = fb.meta.Seek(0, io.SeekStart)
-	if err != nil {
-		log.Printf("seek meta error: %s %s", fb.filename, err)
+func (fb *FileBackend) Read() (p []byte, err error) {
+	records, err := fb.ReadBatch(1)
+	if len(records) > 0 {
+		p = records[0]
+	}
+	return
+}
+
+// ReadBatch reads up to n records of the first segment, the records are consumed together by UpdateMeta,
+// partly by CommitBatch, or read again after RollbackMeta
+func (fb *FileBackend) ReadBatch(n int) (records [][]byte, err error) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+
+	fb.batch = nil
+	p, err := fb.readFirst()
+	if p == nil {
 		return
 	}
+	records = append(records, p)
+	fb.batch = []int64{int64(recordHeaderSize + len(p))}
+	fb.batchSeq, fb.batchOffset = fb.segments[0].seq, fb.offset
+	pos := fb.offset + fb.batch[0]
+	for len(records) < n && pos < fb.segments[0].size {
+		p, err = fb.readRecord(pos)
+		if err != nil {
+			// the record is read again or skipped if corrupted by the next read once the batch is consumed
+			_, err = fb.consumer.Seek(pos, io.SeekStart)
+			break
+		}
+		records = append(records, p)
+		fb.batch = append(fb.batch, int64(recordHeaderSize+len(p)))
+		pos += int64(recordHeaderSize + len(p))
+	}
+	return
+}
 
-	var offset int64
-	err = binary.Read(fb.meta, binary.BigEndian, &offset)
-	if err != nil {
-		if err != io.EOF {
-			log.Printf("read meta error: %s %s", fb.filename, err)
+// readFirst reads the record at the consumer offset, the consumed segments, the expired segments
+// and the corrupted data before the record are removed
+func (fb *FileBackend) readFirst() (p []byte, err error) {
+	for len(fb.segments) > 1 && fb.offset >= fb.segments[0].size {
+		err = fb.removeSegment()
+		if err != nil {
+			return
 		}
+	}
+	for {
+		fb.expire()
+		if fb.size <= fb.offset {
+			return nil, nil
+		}
+		p, err = fb.readRecord(fb.offset)
+		if err != errCorruptedRecord {
+			return
+		}
+		err = fb.skipCorrupted()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readRecord reads the record at pos where the consumer is, a record shorter than the segment size
+// or mismatched in magic, length or crc is corrupted, and the consumer is moved back to pos on other errors
+// so that the record is read again
+func (fb *FileBackend) readRecord(pos int64) (p []byte, err error) {
+	var header [recordHeaderSize]byte
+	_, err = io.ReadFull(fb.consumer, header[:])
+	if err != nil {
+		log.Printf("read header error: %s %s", fb.filename, err)
+		return nil, fb.readError(pos, err)
+	}
+	length := binary.BigEndian.Uint32(header[4:8])
+	if binary.BigEndian.Uint32(header[0:4]) != recordMagic || int64(length) > fb.segments[0].size-pos-recordHeaderSize {
+		return nil, errCorruptedRecord
+	}
+	b := make([]byte, recordHeaderSize+int(length))
+	copy(b, header[:])
+	_, err = io.ReadFull(fb.consumer, b[recordHeaderSize:])
+	if err != nil {
+		log.Printf("read error: %s %s", fb.filename, err)
+		return nil, fb.readError(pos, err)
+	}
+	p, _, n := decodeRecord(b)
+	if n == 0 {
+		return nil, errCorruptedRecord
+	}
+	return
+}
+
+func (fb *FileBackend) readError(pos int64, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errCorruptedRecord
+	}
+	_, serr := fb.consumer.Seek(pos, io.SeekStart)
+	if serr != nil {
+		log.Printf("seek consumer error: %s %s", fb.filename, serr)
+	}
+	return err
+}
+
+// skipCorrupted quarantines the data from the consumer offset to the next valid record in the segment
+// and commits the consumer there
+func (fb *FileBackend) skipCorrupted() (err error) {
+	b := make([]byte, fb.segments[0].size-fb.offset)
+	_, err = fb.consumer.ReadAt(b, fb.offset)
+	if err != nil && err != io.EOF {
+		log.Printf("read consumer error: %s %s", fb.filename, err)
 		return
 	}
+	n := int64(1 + nextRecord(b[1:]))
+	fb.quarantine(b[:n])
+	_, err = fb.consumer.Seek(fb.offset+n, io.SeekStart)
+	if err != nil {
+		log.Printf("seek consumer error: %s %s", fb.filename, err)
+		return
+	}
+	return fb.commit(fb.offset + n)
+}
 
-	_, err = fb.consumer.Seek(offset, io.SeekStart)
+func (fb *FileBackend) RollbackMeta() (err error) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+
+	fb.batch = nil
+	_, err = fb.consumer.Seek(fb.offset, io.SeekStart)
 	if err != nil {
 		log.Printf("seek consumer error: %s %s", fb.filename, err)
 		return
@@ -139,49 +657,89 @@ func (fb *FileBackend) UpdateMeta() (err error) {
 	fb.lock.Lock()
 	defer fb.lock.Unlock()
 
-	producerOffset, err := fb.producer.Seek(0, io.SeekCurrent)
+	if fb.staleBatch(len(fb.batch)) {
+		return fb.discardBatch()
+	}
+	offset, err := fb.consumer.Seek(0, io.SeekCurrent)
 	if err != nil {
-		log.Printf("seek producer error: %s %s", fb.filename, err)
+		log.Printf("seek consumer error: %s %s", fb.filename, err)
 		return
 	}
+	fb.consume(len(fb.batch))
+	return fb.commit(offset)
+}
 
-	offset, err := fb.consumer.Seek(0, io.SeekCurrent)
+// CommitBatch consumes the first n records of the batch read, the others are read again by the next batch,
+// the batch is discarded if its records have been dropped, purged or quarantined meanwhile
+func (fb *FileBackend) CommitBatch(n int) (err error) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+
+	if n > 0 && fb.staleBatch(n) {
+		return fb.discardBatch()
+	}
+	offset := fb.offset
+	for _, size := range fb.batch[:n] {
+		offset += size
+	}
+	fb.consume(n)
+	_, err = fb.consumer.Seek(offset, io.SeekStart)
 	if err != nil {
 		log.Printf("seek consumer error: %s %s", fb.filename, err)
 		return
 	}
+	if n == 0 {
+		return
+	}
+	return fb.commit(offset)
+}
+
+func (fb *FileBackend) staleBatch(n int) bool {
+	return fb.batch == nil || n > len(fb.batch) || fb.segments[0].seq != fb.batchSeq || fb.offset != fb.batchOffset
+}
+
+// discardBatch moves the consumer back to the offset without consuming the batch
+func (fb *FileBackend) discardBatch() (err error) {
+	log.Printf("spool discard stale batch: %s, records: %d", fb.filename, len(fb.batch))
+	fb.batch = nil
+	_, err = fb.consumer.Seek(fb.offset, io.SeekStart)
+	if err != nil {
+		log.Printf("seek consumer error: %s %s", fb.filename, err)
+	}
+	return
+}
+
+func (fb *FileBackend) consume(n int) {
+	fb.segments[0].records -= int64(n)
+	if fb.segments[0].records < 0 {
+		fb.segments[0].records = 0
+	}
+	fb.batch = nil
+}
+
+func (fb *FileBackend) commit(offset int64) (err error) {
+	fb.offset = offset
 
-	if producerOffset == offset {
+	if offset >= fb.segments[0].size {
+		if len(fb.segments) > 1 {
+			return fb.removeSegment()
+		}
 		err = fb.CleanUp()
 		if err != nil {
 			log.Printf("cleanup error: %s %s", fb.filename, err)
 			return
 		}
-		offset = 0
 	}
 
-	_, err = fb.meta.Seek(0, io.SeekStart)
+	err = fb.writeMeta()
 	if err != nil {
-		log.Printf("seek meta error: %s %s", fb.filename, err)
 		return
 	}
-
-	log.Printf("write meta: %s, %d", fb.filename, offset)
-	err = binary.Write(fb.meta, binary.BigEndian, &offset)
-	if err != nil {
-		log.Printf("write meta error: %s %s", fb.filename, err)
-		return
-	}
-
-	err = fb.meta.Sync()
-	if err != nil {
-		log.Printf("sync meta error: %s %s", fb.filename, err)
-		return
-	}
-
+	fb.updatePending()
 	return
 }
 
+// CleanUp truncates the last segment which has been fully consumed
 func (fb *FileBackend) CleanUp() (err error) {
 	_, err = fb.consumer.Seek(0, io.SeekStart)
 	if err != nil {
@@ -198,18 +756,94 @@ func (fb *FileBackend) CleanUp() (err error) {
 		log.Print("close producer error: ", err)
 		return
 	}
-	pathname := filepath.Join(fb.datadir, fb.filename)
-	fb.producer, err = os.OpenFile(pathname+".dat", os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	fb.producer, err = os.OpenFile(fb.segmentPath(fb.lastSegment().seq), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
 		log.Print("open producer error: ", err)
 		return
 	}
-	fb.dataflag = false
+	fb.lastSegment().size = 0
+	fb.lastSegment().records = 0
+	fb.size = 0
+	fb.offset = 0
 	return
 }
 
+// Purge drops all the data not consumed yet
+func (fb *FileBackend) Purge() (err error) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+
+	dropped := fb.size - fb.offset
+	fb.batch = nil
+	for len(fb.segments) > 1 {
+		err = fb.removeSegment()
+		if err != nil {
+			return
+		}
+	}
+	err = fb.CleanUp()
+	if err != nil {
+		return
+	}
+	err = fb.writeMeta()
+	if err != nil {
+		return
+	}
+	fb.updatePending()
+	log.Printf("spool purge: %s, length: %d", fb.filename, dropped)
+	SpoolDroppedBytes.WithLabelValues(fb.filename, "purged").Add(float64(dropped))
+	return
+}
+
+func (fb *FileBackend) Stats() *SpoolStats {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+
+	stats := &SpoolStats{
+		Bytes:    fb.size - fb.offset,
+		Segments: len(fb.segments),
+		Segment:  fb.segments[0].seq,
+		Offset:   fb.offset,
+	}
+	for _, seg := range fb.segments {
+		stats.Records += seg.records
+	}
+	if stats.Bytes > 0 {
+		var header [recordHeaderSize]byte
+		err := fb.readOldestHeader(header[:])
+		if err == nil && binary.BigEndian.Uint32(header[0:4]) == recordMagic {
+			oldest := time.Unix(0, int64(binary.BigEndian.Uint64(header[8:16])))
+			stats.Oldest = &oldest
+		}
+	}
+	return stats
+}
+
+// readOldestHeader reads the header of the first record not consumed, which is in the next segment
+// with data if the first segment is consumed but not removed yet
+func (fb *FileBackend) readOldestHeader(header []byte) (err error) {
+	if fb.offset < fb.segments[0].size {
+		_, err = fb.consumer.ReadAt(header, fb.offset)
+		return
+	}
+	for _, seg := range fb.segments[1:] {
+		if seg.size == 0 {
+			continue
+		}
+		f, err := os.Open(fb.segmentPath(seg.seq))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = f.ReadAt(header, 0)
+		return err
+	}
+	return io.EOF
+}
+
 func (fb *FileBackend) Close() {
 	fb.producer.Close()
 	fb.consumer.Close()
 	fb.meta.Close()
+	SpoolPendingBytes.DeleteLabelValues(fb.filename)
 }
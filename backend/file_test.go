@@ -0,0 +1,308 @@
+package backend
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestFileBackend(t *testing.T, cfg *ProxyConfig) *FileBackend {
+	fb, err := NewFileBackend("fb", cfg.DataDir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fb
+}
+
+func readAll(t *testing.T, fb *FileBackend) (records []string) {
+	for fb.IsData() {
+		p, err := fb.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p == nil {
+			break
+		}
+		records = append(records, string(p))
+		fb.UpdateMeta()
+	}
+	return
+}
+
+func countSegments(dir string) int {
+	matches, _ := filepath.Glob(filepath.Join(dir, "fb.dat.*"))
+	return len(matches)
+}
+
+func TestFileBackendSegments(t *testing.T) {
+	cfg := newTestProxyConfig(t)
+	cfg.SpoolSegmentSize = 2 * (recordHeaderSize + 8)
+	fb := newTestFileBackend(t, cfg)
+	for _, r := range []string{"record-1", "record-2", "record-3", "record-4", "record-5"} {
+		fb.Write([]byte(r))
+	}
+	if n := countSegments(cfg.DataDir); n != 3 {
+		t.Errorf("segments: got %d, want 3", n)
+	}
+
+	p, _ := fb.Read()
+	fb.UpdateMeta()
+	p, _ = fb.Read()
+	fb.RollbackMeta()
+	fb.Close()
+
+	// the consumer resumes from the meta after restart
+	fb = newTestFileBackend(t, cfg)
+	defer fb.Close()
+	records := readAll(t, fb)
+	if len(records) != 4 || string(p) != "record-2" || records[0] != "record-2" || records[3] != "record-5" {
+		t.Errorf("records: got %v", records)
+	}
+	if n := countSegments(cfg.DataDir); n != 1 || fb.IsData() {
+		t.Errorf("consumed segments not removed: %d", n)
+	}
+}
+
+func TestFileBackendLimits(t *testing.T) {
+	cfg := newTestProxyConfig(t)
+	cfg.SpoolSegmentSize = recordHeaderSize + 8
+	cfg.SpoolMaxSize = 3 * (recordHeaderSize + 8)
+	fb := newTestFileBackend(t, cfg)
+	for _, r := range []string{"record-1", "record-2", "record-3", "record-4", "record-5"} {
+		if err := fb.Write([]byte(r)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records := readAll(t, fb)
+	if len(records) != 3 || records[0] != "record-3" {
+		t.Errorf("drop-oldest records: got %v", records)
+	}
+	fb.Close()
+
+	cfg = newTestProxyConfig(t)
+	cfg.SpoolMaxSize = 3 * (recordHeaderSize + 8)
+	cfg.SpoolPolicy = SpoolPolicyRejectNew
+	fb = newTestFileBackend(t, cfg)
+	var rejected int
+	for _, r := range []string{"record-1", "record-2", "record-3", "record-4", "record-5"} {
+		if err := fb.Write([]byte(r)); err == ErrSpoolFull {
+			rejected++
+		}
+	}
+	records = readAll(t, fb)
+	if rejected != 2 || len(records) != 3 || records[2] != "record-3" {
+		t.Errorf("reject-new records: got %v, rejected %d", records, rejected)
+	}
+	fb.Close()
+
+	cfg = newTestProxyConfig(t)
+	cfg.SpoolMaxAge = 1
+	fb = newTestFileBackend(t, cfg)
+	defer fb.Close()
+	fb.Write([]byte("record-1"))
+	fb.segments[0].modTime = time.Now().Add(-2 * time.Second)
+	fb.Write([]byte("record-2"))
+	records = readAll(t, fb)
+	if len(records) != 1 || records[0] != "record-2" {
+		t.Errorf("expired records: got %v", records)
+	}
+}
+
+func TestFileBackendLegacy(t *testing.T) {
+	cfg := newTestProxyConfig(t)
+	var data []byte
+	for _, r := range []string{"record-1", "record-2"} {
+		data = append(data, 0, 0, 0, byte(len(r)))
+		data = append(data, r...)
+	}
+	ioutil.WriteFile(filepath.Join(cfg.DataDir, "fb.dat"), data, 0644)
+	meta := make([]byte, 8)
+	binary.BigEndian.PutUint64(meta, 12)
+	ioutil.WriteFile(filepath.Join(cfg.DataDir, "fb.rec"), meta, 0644)
+
+	fb := newTestFileBackend(t, cfg)
+	defer fb.Close()
+	records := readAll(t, fb)
+	if len(records) != 1 || records[0] != "record-2" {
+		t.Errorf("legacy records: got %v", records)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.DataDir, "fb.dat")); !os.IsNotExist(err) {
+		t.Errorf("legacy data file not migrated: %v", err)
+	}
+}
+
+func TestFileBackendCorrupted(t *testing.T) {
+	cfg := newTestProxyConfig(t)
+	fb := newTestFileBackend(t, cfg)
+	for _, r := range []string{"record-1", "record-2", "record-3"} {
+		fb.Write([]byte(r))
+	}
+	fb.Close()
+
+	// flip a byte of record-2 and leave a torn record at the end
+	path := fb.segmentPath(1)
+	data, _ := ioutil.ReadFile(path)
+	data[2*recordHeaderSize+8+1] ^= 0xff
+	data = append(data, encodeRecord([]byte("record-4"), 0)[:10]...)
+	ioutil.WriteFile(path, data, 0644)
+
+	fb = newTestFileBackend(t, cfg)
+	defer fb.Close()
+	if fb.size != int64(3*(recordHeaderSize+8)) {
+		t.Errorf("torn record not truncated: %d", fb.size)
+	}
+	records := readAll(t, fb)
+	if len(records) != 2 || records[0] != "record-1" || records[1] != "record-3" {
+		t.Errorf("records: got %v", records)
+	}
+	bad, _ := ioutil.ReadFile(filepath.Join(cfg.DataDir, "fb.bad"))
+	if len(bad) != recordHeaderSize+8+10 {
+		t.Errorf("quarantined bytes: got %d", len(bad))
+	}
+}
+
+func TestFileBackendStats(t *testing.T) {
+	cfg := newTestProxyConfig(t)
+	cfg.SpoolSegmentSize = 2 * (recordHeaderSize + 8)
+	fb := newTestFileBackend(t, cfg)
+	defer fb.Close()
+	start := time.Now()
+	for _, r := range []string{"record-1", "record-2", "record-3"} {
+		fb.Write([]byte(r))
+	}
+	fb.Read()
+	fb.UpdateMeta()
+	stats := fb.Stats()
+	if stats.Records != 2 || stats.Bytes != 2*(recordHeaderSize+8) || stats.Segments != 2 || stats.Segment != 1 || stats.Offset != recordHeaderSize+8 {
+		t.Errorf("stats: got %+v", stats)
+	}
+	if stats.Oldest == nil || stats.Oldest.Before(start) {
+		t.Errorf("oldest: got %v", stats.Oldest)
+	}
+	// the oldest is in the next segment when the first one is consumed but not removed yet
+	fb.offset = fb.segments[0].size
+	if stats = fb.Stats(); stats.Oldest == nil || stats.Oldest.Before(start) {
+		t.Errorf("oldest in next segment: got %v", stats.Oldest)
+	}
+
+	fb.Purge()
+	stats = fb.Stats()
+	if fb.IsData() || stats.Records != 0 || stats.Segments != 1 || stats.Oldest != nil {
+		t.Errorf("purged stats: got %+v", stats)
+	}
+	fb.Write([]byte("record-4"))
+	if records := readAll(t, fb); len(records) != 1 || records[0] != "record-4" {
+		t.Errorf("records after purge: got %v", records)
+	}
+}
+
+func TestFileBackendReadBatch(t *testing.T) {
+	cfg := newTestProxyConfig(t)
+	cfg.SpoolSegmentSize = 3 * (recordHeaderSize + 8)
+	fb := newTestFileBackend(t, cfg)
+	defer fb.Close()
+	for _, r := range []string{"record-1", "record-2", "record-3", "record-4"} {
+		fb.Write([]byte(r))
+	}
+
+	// a batch stops at the end of the segment
+	records, _ := fb.ReadBatch(5)
+	if len(records) != 3 || string(records[2]) != "record-3" {
+		t.Errorf("batch: got %q", records)
+	}
+	fb.RollbackMeta()
+	records, _ = fb.ReadBatch(2)
+	fb.UpdateMeta()
+	if len(records) != 2 || string(records[0]) != "record-1" || fb.Stats().Records != 2 {
+		t.Errorf("batch after rollback: got %q, stats %+v", records, fb.Stats())
+	}
+	records, _ = fb.ReadBatch(2)
+	fb.UpdateMeta()
+	if len(records) != 1 || string(records[0]) != "record-3" {
+		t.Errorf("batch: got %q", records)
+	}
+	records, _ = fb.ReadBatch(2)
+	if len(records) != 1 || string(records[0]) != "record-4" {
+		t.Errorf("batch of next segment: got %q", records)
+	}
+}
+
+func TestFileBackendCommitBatch(t *testing.T) {
+	cfg := newTestProxyConfig(t)
+	fb := newTestFileBackend(t, cfg)
+	defer fb.Close()
+	for _, r := range []string{"record-1", "record-2", "record-3", "record-4"} {
+		fb.Write([]byte(r))
+	}
+
+	// the records after the committed prefix are read again in order
+	fb.ReadBatch(3)
+	fb.CommitBatch(1)
+	records, _ := fb.ReadBatch(2)
+	if len(records) != 2 || string(records[0]) != "record-2" || fb.Stats().Records != 3 {
+		t.Errorf("batch after commit: got %q, stats %+v", records, fb.Stats())
+	}
+	fb.CommitBatch(0)
+	fb.ReadBatch(3)
+	fb.CommitBatch(3)
+	if fb.IsData() {
+		t.Errorf("data left after commit: %+v", fb.Stats())
+	}
+}
+
+func TestFileBackendStaleBatch(t *testing.T) {
+	cfg := newTestProxyConfig(t)
+	cfg.SpoolSegmentSize = 2 * (recordHeaderSize + 3)
+	cfg.SpoolMaxSize = 4 * (recordHeaderSize + 3)
+	fb := newTestFileBackend(t, cfg)
+	defer fb.Close()
+	for _, r := range []string{"aaa", "bbb", "ccc", "ddd"} {
+		fb.Write([]byte(r))
+	}
+
+	// the segment of the batch is dropped for the new record, the commit does not skip the next segment
+	fb.ReadBatch(2)
+	fb.Write([]byte("eee"))
+	if err := fb.CommitBatch(2); err != nil {
+		t.Fatal(err)
+	}
+	if records := readAll(t, fb); len(records) != 3 || records[0] != "ccc" {
+		t.Errorf("records after drop: got %q", records)
+	}
+
+	// the commit of a batch purged meanwhile is discarded
+	fb.Write([]byte("fff"))
+	fb.Write([]byte("ggg"))
+	fb.ReadBatch(2)
+	fb.Purge()
+	fb.Write([]byte("hhh"))
+	if err := fb.CommitBatch(2); err != nil {
+		t.Fatal(err)
+	}
+	if records := readAll(t, fb); len(records) != 1 || records[0] != "hhh" {
+		t.Errorf("records after purge: got %q", records)
+	}
+}
+
+func TestFileBackendReadError(t *testing.T) {
+	cfg := newTestProxyConfig(t)
+	fb := newTestFileBackend(t, cfg)
+	defer fb.Close()
+	fb.Write([]byte("record-1"))
+
+	// an i/o error is returned and the record is read again, but not quarantined as corrupted
+	fb.consumer.Close()
+	if _, err := fb.Read(); err == nil || err == errCorruptedRecord {
+		t.Errorf("read error: got %v", err)
+	}
+	fb.openConsumer(fb.offset)
+	if p, err := fb.Read(); err != nil || string(p) != "record-1" {
+		t.Errorf("read again: got %q %v", p, err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.DataDir, "fb.bad")); !os.IsNotExist(err) {
+		t.Errorf("record quarantined: %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package backend
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -12,6 +13,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -28,33 +30,57 @@ var (
 )
 
 type QueryResult struct {
-	Header http.Header
-	Status int
-	Body   []byte
-	Err    error
+	Header   http.Header
+	Status   int
+	Body     []byte
+	Err      error
+	Streamed bool
 }
 
 type HttpBackend struct { // nolint:golint
-	client      *http.Client
+	client      atomic.Value
 	transport   *http.Transport
 	Name        string
 	Url         string // nolint:golint
 	Username    string
 	Password    string
 	AuthEncrypt bool
-	interval    int
+	interval    atomic.Value
+	ctx         context.Context
+	cancel      context.CancelFunc
+	chStop      chan struct{}
 	active      atomic.Value
 	rewriting   atomic.Value
+	breaker     *CircuitBreaker
+	outstanding int32
+	latencyLock sync.Mutex
+	latency     float64
 }
 
 func NewHttpBackend(cfg *BackendConfig, pxcfg *ProxyConfig) (hb *HttpBackend) { // nolint:golint
 	hb = NewSimpleHttpBackend(cfg)
-	hb.client = NewClient(strings.HasPrefix(cfg.Url, "https"), pxcfg.WriteTimeout)
-	hb.interval = pxcfg.CheckInterval
+	hb.client.Store(NewClient(strings.HasPrefix(cfg.Url, "https"), pxcfg.WriteTimeout))
+	hb.interval.Store(pxcfg.CheckInterval)
+	hb.breaker.Reload(pxcfg)
 	go hb.CheckActive()
 	return
 }
 
+// Reload applies the check interval and write timeout of pxcfg, keeping the connections of the transport
+func (hb *HttpBackend) Reload(pxcfg *ProxyConfig) {
+	hb.interval.Store(pxcfg.CheckInterval)
+	hb.breaker.Reload(pxcfg)
+	client := hb.getClient()
+	if client != nil && client.Timeout != time.Duration(pxcfg.WriteTimeout)*time.Second {
+		hb.client.Store(&http.Client{Transport: client.Transport, Timeout: time.Duration(pxcfg.WriteTimeout) * time.Second})
+	}
+}
+
+func (hb *HttpBackend) getClient() *http.Client {
+	client, _ := hb.client.Load().(*http.Client)
+	return client
+}
+
 func NewSimpleHttpBackend(cfg *BackendConfig) (hb *HttpBackend) { // nolint:golint
 	hb = &HttpBackend{
 		transport:   NewTransport(strings.HasPrefix(cfg.Url, "https")),
@@ -63,7 +89,10 @@ func NewSimpleHttpBackend(cfg *BackendConfig) (hb *HttpBackend) { // nolint:goli
 		Username:    cfg.Username,
 		Password:    cfg.Password,
 		AuthEncrypt: cfg.AuthEncrypt,
+		breaker:     NewCircuitBreaker(cfg.Name),
+		chStop:      make(chan struct{}),
 	}
+	hb.ctx, hb.cancel = context.WithCancel(context.Background())
 	hb.active.Store(true)
 	hb.rewriting.Store(false)
 	return
@@ -108,6 +137,48 @@ func CloneQueryRequest(r *http.Request) *http.Request {
 	return cr
 }
 
+// headerRecorder records the headers of a statement of a multi-statement query
+type headerRecorder struct {
+	header http.Header
+}
+
+func (hr *headerRecorder) Header() http.Header {
+	return hr.header
+}
+
+func (hr *headerRecorder) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (hr *headerRecorder) WriteHeader(int) {
+}
+
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+// newFlushWriter returns a writer which flushes the response to the client after each write
+func newFlushWriter(w http.ResponseWriter) io.Writer {
+	return &flushWriter{w: w}
+}
+
+func (fw *flushWriter) Write(p []byte) (n int, err error) {
+	n, err = fw.w.Write(p)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return
+}
+
+func GzipDecompress(b []byte) ([]byte, error) {
+	zip, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer zip.Close()
+	return ioutil.ReadAll(zip)
+}
+
 func Compress(buf *bytes.Buffer, p []byte) (err error) {
 	zip := gzip.NewWriter(buf)
 	defer zip.Close()
@@ -142,15 +213,27 @@ func (hb *HttpBackend) SetBasicAuth(req *http.Request) {
 	SetBasicAuth(req, hb.Username, hb.Password, hb.AuthEncrypt)
 }
 
+// CheckActive pings the backend every check interval until the backend is closed
 func (hb *HttpBackend) CheckActive() {
 	for {
-		hb.active.Store(hb.Ping())
-		time.Sleep(time.Duration(hb.interval) * time.Second)
+		hb.SetActive(hb.Ping())
+		select {
+		case <-hb.chStop:
+			BackendActive.DeleteLabelValues(hb.Name)
+			return
+		case <-time.After(time.Duration(hb.interval.Load().(int)) * time.Second):
+		}
 	}
 }
 
+// IsActive reports whether the backend answers ping and its circuit breaker is not open
 func (hb *HttpBackend) IsActive() (b bool) {
-	return hb.active.Load().(bool)
+	return hb.active.Load().(bool) && !hb.breaker.IsOpen()
+}
+
+func (hb *HttpBackend) SetActive(b bool) {
+	hb.active.Store(b)
+	BackendActive.WithLabelValues(hb.Name).Set(boolToFloat(b))
 }
 
 func (hb *HttpBackend) IsRewriting() (b bool) {
@@ -159,10 +242,11 @@ func (hb *HttpBackend) IsRewriting() (b bool) {
 
 func (hb *HttpBackend) SetRewriting(b bool) {
 	hb.rewriting.Store(b)
+	BackendRewriting.WithLabelValues(hb.Name).Set(boolToFloat(b))
 }
 
 func (hb *HttpBackend) Ping() bool {
-	resp, err := hb.client.Get(hb.Url + "/ping")
+	resp, err := hb.getClient().Get(hb.Url + "/ping")
 	if err != nil {
 		log.Print("http error: ", err)
 		return false
@@ -182,32 +266,41 @@ func (hb *HttpBackend) Write(db string, p []byte) (err error) {
 		log.Print("compress error: ", err)
 		return
 	}
-	return hb.WriteStream(db, &buf, true)
+	return hb.WriteStream(db, "", &buf, true)
 }
 
-func (hb *HttpBackend) WriteCompressed(db string, p []byte) (err error) {
+func (hb *HttpBackend) WriteCompressed(db, rp string, p []byte) (err error) {
 	buf := bytes.NewBuffer(p)
-	return hb.WriteStream(db, buf, true)
+	return hb.WriteStream(db, rp, buf, true)
 }
 
-func (hb *HttpBackend) WriteStream(db string, stream io.Reader, compressed bool) (err error) {
+func (hb *HttpBackend) WriteStream(db, rp string, stream io.Reader, compressed bool) (err error) {
 	q := url.Values{}
 	q.Set("db", db)
-	req, err := http.NewRequest("POST", hb.Url+"/write?"+q.Encode(), stream)
+	if rp != "" {
+		q.Set("rp", rp)
+	}
+	req, err := http.NewRequestWithContext(hb.ctx, "POST", hb.Url+"/write?"+q.Encode(), stream)
 	if hb.Username != "" || hb.Password != "" {
 		hb.SetBasicAuth(req)
 	}
 	if compressed {
 		req.Header.Add("Content-Encoding", "gzip")
 	}
+	if !hb.breaker.Allow() {
+		return ErrCircuitOpen
+	}
 
-	resp, err := hb.client.Do(req)
+	start := time.Now()
+	resp, err := hb.getClient().Do(req)
 	if err != nil {
 		log.Print("http error: ", err)
-		hb.active.Store(false)
+		hb.breaker.Record(true, time.Since(start))
+		hb.SetActive(false)
 		return
 	}
 	defer resp.Body.Close()
+	hb.breaker.Record(resp.StatusCode >= 500, time.Since(start))
 
 	if resp.StatusCode == 204 {
 		return
@@ -236,8 +329,7 @@ func (hb *HttpBackend) WriteStream(db string, stream io.Reader, compressed bool)
 	return
 }
 
-func (hb *HttpBackend) Query(req *http.Request, w http.ResponseWriter, decompress bool) (qr *QueryResult) {
-	qr = &QueryResult{}
+func (hb *HttpBackend) roundTripQuery(req *http.Request) (resp *http.Response, err error) {
 	if len(req.Form) == 0 {
 		req.Form = url.Values{}
 	}
@@ -248,19 +340,71 @@ func (hb *HttpBackend) Query(req *http.Request, w http.ResponseWriter, decompres
 		hb.SetBasicAuth(req)
 	}
 
-	req.URL, qr.Err = url.Parse(hb.Url + "/query?" + req.Form.Encode())
-	if qr.Err != nil {
-		log.Print("internal url parse error: ", qr.Err)
+	req.URL, err = url.Parse(hb.Url + "/query?" + req.Form.Encode())
+	if err != nil {
+		log.Print("internal url parse error: ", err)
 		return
 	}
 
-	q := strings.TrimSpace(req.FormValue("q"))
-	resp, err := hb.transport.RoundTrip(req)
+	if !hb.breaker.Allow() {
+		return nil, ErrCircuitOpen
+	}
+	start := time.Now()
+	resp, err = hb.transport.RoundTrip(req)
 	if err != nil {
-		if req.Header.Get("Query-Origin") != "Parallel" || err.Error() != "context canceled" {
-			qr.Err = err
-			log.Printf("query error: %s, the query is %s", err, q)
+		if req.Context().Err() != nil {
+			// canceled by the client or by the other queries in parallel, not a failure of the backend
+			hb.breaker.Cancel()
+			if req.Header.Get("Query-Origin") == "Parallel" {
+				err = nil
+			}
+			return
 		}
+		log.Printf("query error: %s, the query is %s", err, strings.TrimSpace(req.FormValue("q")))
+		hb.breaker.Record(true, time.Since(start))
+		return
+	}
+	hb.breaker.Record(resp.StatusCode >= 500, time.Since(start))
+	return
+}
+
+// beginQuery counts the query as outstanding, the returned func ends it and updates the ewma of query latency
+// if the query is completed with a response
+func (hb *HttpBackend) beginQuery() func(qr *QueryResult) {
+	atomic.AddInt32(&hb.outstanding, 1)
+	start := time.Now()
+	return func(qr *QueryResult) {
+		atomic.AddInt32(&hb.outstanding, -1)
+		if qr.Status <= 0 {
+			return
+		}
+		latency := time.Since(start).Seconds()
+		hb.latencyLock.Lock()
+		defer hb.latencyLock.Unlock()
+		if hb.latency > 0 {
+			latency = 0.3*latency + 0.7*hb.latency
+		}
+		hb.latency = latency
+	}
+}
+
+func (hb *HttpBackend) OutstandingQueries() int {
+	return int(atomic.LoadInt32(&hb.outstanding))
+}
+
+// QueryLatency returns the ewma of query latency in seconds
+func (hb *HttpBackend) QueryLatency() float64 {
+	hb.latencyLock.Lock()
+	defer hb.latencyLock.Unlock()
+	return hb.latency
+}
+
+func (hb *HttpBackend) Query(req *http.Request, w http.ResponseWriter, decompress bool) (qr *QueryResult) {
+	qr = &QueryResult{}
+	defer hb.beginQuery()(qr)
+	resp, err := hb.roundTripQuery(req)
+	if err != nil || resp == nil {
+		qr.Err = err
 		return
 	}
 	defer resp.Body.Close()
@@ -280,20 +424,65 @@ func (hb *HttpBackend) Query(req *http.Request, w http.ResponseWriter, decompres
 		respBody = b
 	}
 
+	q := strings.TrimSpace(req.FormValue("q"))
 	qr.Body, qr.Err = ioutil.ReadAll(respBody)
 	if qr.Err != nil {
 		log.Printf("read body error: %s, the query is %s", qr.Err, q)
 		return
 	}
 	if resp.StatusCode >= 400 {
-		rsp, _ := ResponseFromResponseBytes(qr.Body)
-		qr.Err = errors.New(rsp.Err)
+		qr.Err = responseError(resp.StatusCode, qr.Body)
 	}
 	qr.Header = resp.Header
 	qr.Status = resp.StatusCode
 	return
 }
 
+// responseError returns the error of a failed response, which is the body or the status text
+// if the body is not a json error
+func responseError(status int, body []byte) error {
+	if rsp, err := ResponseFromResponseBytes(body); err == nil && rsp.Err != "" {
+		return errors.New(rsp.Err)
+	}
+	if text := strings.TrimSpace(string(body)); text != "" {
+		return errors.New(text)
+	}
+	return errors.New(http.StatusText(status))
+}
+
+// QueryStream streams the body of a successful query to w instead of reading it into memory,
+// the body is only read when the backend fails, so that the query can be retried or the error returned
+func (hb *HttpBackend) QueryStream(req *http.Request, w http.ResponseWriter) (qr *QueryResult) {
+	qr = &QueryResult{}
+	defer hb.beginQuery()(qr)
+	resp, err := hb.roundTripQuery(req)
+	if err != nil || resp == nil {
+		qr.Err = err
+		return
+	}
+	defer resp.Body.Close()
+	qr.Header = resp.Header
+	qr.Status = resp.StatusCode
+	if resp.StatusCode >= 400 {
+		qr.Body, qr.Err = ioutil.ReadAll(resp.Body)
+		if qr.Err == nil {
+			qr.Err = responseError(resp.StatusCode, qr.Body)
+		}
+		return
+	}
+
+	CopyHeader(w.Header(), resp.Header)
+	w.Header().Del("Content-Length")
+	w.Header().Set("X-Influxdb-Version", Version)
+	w.WriteHeader(resp.StatusCode)
+	qr.Streamed = true
+	fw := newFlushWriter(w)
+	if _, err = io.Copy(fw, resp.Body); err != nil {
+		log.Printf("stream body error: %s, the query is %s", err, strings.TrimSpace(req.FormValue("q")))
+	}
+	return
+}
+
 func (hb *HttpBackend) QueryIQL(method, db, q, epoch string) ([]byte, error) {
 	qr := hb.Query(NewQueryRequest(method, db, q, epoch), nil, true)
 	return qr.Body, qr.Err
@@ -353,6 +542,15 @@ func (hb *HttpBackend) DropMeasurement(db, meas string) ([]byte, error) {
 	return qr.Body, qr.Err
 }
 
+// CancelWrites aborts the writes in flight and the following ones
+func (hb *HttpBackend) CancelWrites() {
+	hb.cancel()
+}
+
+// Close stops the check of the backend and deletes its metrics
 func (hb *HttpBackend) Close() {
+	close(hb.chStop)
 	hb.transport.CloseIdleConnections()
+	BackendRewriting.DeleteLabelValues(hb.Name)
+	BackendBreakerState.DeleteLabelValues(hb.Name)
 }
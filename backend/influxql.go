@@ -1,314 +1,222 @@
 package backend
 
 import (
-	"bufio"
-	"bytes"
+	"encoding/json"
 	"errors"
-	"log"
 	"strings"
 
-	"github.com/tixff/influx-proxy/util"
-)
-
-var SupportCmds = util.NewSet(
-	"show measurements",
-	"show series",
-	"show field keys",
-	"show tag keys",
-	"show tag values",
-	"show retention policies",
-	"show stats",
-	"show databases",
-	"create database",
-	"drop database",
-	"delete from",
-	"drop series from",
-	"drop measurement",
+	"github.com/influxdata/influxql"
 )
 
 var (
-	ErrWrongQuote     = errors.New("wrong quote")
-	ErrUnmatchedQuote = errors.New("unmatched quote")
-	ErrUnclosed       = errors.New("unclosed parenthesis")
-	ErrIllegalQL      = errors.New("illegal InfluxQL")
+	ErrIllegalQL = errors.New("illegal InfluxQL")
+	ErrNotSelect = errors.New("not a select statement")
 )
 
-func FindEndWithQuote(data []byte, start int, endchar byte) (end int, unquoted []byte, err error) {
-	unquoted = append(unquoted, data[start])
-	start++
-	for end = start; end < len(data); end++ {
-		switch data[end] {
-		case endchar:
-			unquoted = append(unquoted, data[end])
-			end++
-			return
-		case '\\':
-			switch {
-			case len(data) == end:
-				err = ErrUnmatchedQuote
-				return
-			case data[end+1] == endchar:
-				end++
-				unquoted = append(unquoted, data[end])
-			default:
-				err = ErrWrongQuote
-				return
-			}
-		default:
-			unquoted = append(unquoted, data[end])
+// ParseQuery parses the query with the bound parameters encoded as json
+func ParseQuery(q, params string) (*influxql.Query, error) {
+	p := influxql.NewParser(strings.NewReader(q))
+	if params != "" {
+		var m map[string]interface{}
+		dec := json.NewDecoder(strings.NewReader(params))
+		dec.UseNumber()
+		if err := dec.Decode(&m); err != nil {
+			return nil, errors.New("error parsing query parameters: " + err.Error())
 		}
+		p.SetParams(m)
 	}
-	err = ErrUnmatchedQuote
-	return
+	return p.ParseQuery()
 }
 
-func ScanToken(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	if atEOF && len(data) == 0 {
-		return 0, nil, nil
-	}
-
-	start := 0
-	for ; start < len(data) && data[start] == ' '; start++ {
-	}
-	if start == len(data) {
-		return 0, nil, nil
-	}
-
-	switch data[start] {
-	case '"':
-		advance, token, err = FindEndWithQuote(data, start, '"')
-		if err != nil {
-			log.Printf("scan token error: %s", err)
-		}
-		return
-	case '\'':
-		advance, token, err = FindEndWithQuote(data, start, '\'')
-		if err != nil {
-			log.Printf("scan token error: %s", err)
-		}
-		return
-	case '(':
-		advance = bytes.IndexByte(data[start:], ')')
-		if advance == -1 {
-			err = ErrUnclosed
-		} else {
-			advance += start + 1
-		}
-	case '[':
-		advance = bytes.IndexByte(data[start:], ']')
-		if advance == -1 {
-			err = ErrUnclosed
-		} else {
-			advance += start + 1
-		}
-	case '{':
-		advance = bytes.IndexByte(data[start:], '}')
-		if advance == -1 {
-			err = ErrUnclosed
-		} else {
-			advance += start + 1
-		}
-	case '.':
-		advance = start + 1
-		for ; advance < len(data); advance++ {
-			if data[advance] != '.' {
-				break
-			}
-		}
-	default:
-		advance = bytes.IndexFunc(data[start:], func(r rune) bool {
-			return r == ' '
-		})
-		if advance == -1 {
-			advance = len(data)
-		} else {
-			advance += start
-		}
-
-	}
+func ParseStatement(q, params string) (influxql.Statement, error) {
+	query, err := ParseQuery(q, params)
 	if err != nil {
-		log.Printf("scan token error: %s", err)
-		return
+		return nil, err
 	}
-
-	token = data[start:advance]
-	// fmt.Printf("%s (%d, %d) = %s\n", data, start, advance, token)
-	return
-}
-
-func ScanTokens(q string, n int) (tokens []string) {
-	q = strings.TrimRight(strings.TrimSpace(q), "; ")
-	buf := bytes.NewBuffer([]byte(q))
-	scanner := bufio.NewScanner(buf)
-	scanner.Buffer([]byte(q), len(q))
-	scanner.Split(ScanToken)
-	for scanner.Scan() {
-		tokens = append(tokens, scanner.Text())
-		if n > 0 && len(tokens) == n {
-			return
-		}
-	}
-	return
-}
-
-func GetHeadStmtFromTokens(tokens []string, n int) (stmt string) {
-	if n <= 0 || n > len(tokens) {
-		n = len(tokens)
+	if len(query.Statements) != 1 {
+		return nil, ErrIllegalQL
 	}
-	return strings.ToLower(strings.Join(tokens[:n], " "))
-}
-
-func GetDatabaseFromInfluxQL(q string) (m string, err error) {
-	return GetDatabaseFromTokens(ScanTokens(q, 0))
-}
-
-func GetMeasurementFromInfluxQL(q string) (m string, err error) {
-	return GetMeasurementFromTokens(ScanTokens(q, 0))
-}
-
-func GetDatabaseFromTokens(tokens []string) (m string, err error) {
-	return GetIdentifierFromTokens(tokens, []string{"on", "database"}, getDatabase)
-}
-
-func GetMeasurementFromTokens(tokens []string) (m string, err error) {
-	return GetIdentifierFromTokens(tokens, []string{"from", "measurement"}, getMeasurement)
+	return query.Statements[0], nil
 }
 
-func GetIdentifierFromTokens(tokens []string, keywords []string, fn func([]string) string) (m string, err error) {
-	for i := 0; i < len(tokens); i++ {
-		for j := 0; j < len(keywords); j++ {
-			if strings.ToLower(tokens[i]) == keywords[j] {
-				if i+1 < len(tokens) {
-					m = fn(tokens[i+1:])
-					return
-				}
-			}
+func ParseSelectStatement(q, params string) (*influxql.SelectStatement, error) {
+	stmt, err := ParseStatement(q, params)
+	if err != nil {
+		return nil, err
+	}
+	sstmt, ok := stmt.(*influxql.SelectStatement)
+	if !ok {
+		return nil, ErrNotSelect
+	}
+	return sstmt, nil
+}
+
+// CheckQuery checks whether the statement is supported by the proxy
+func CheckQuery(stmt influxql.Statement) bool {
+	switch s := stmt.(type) {
+	case *influxql.SelectStatement:
+		return s.Target == nil && len(s.Sources) > 0
+	case *influxql.DeleteSeriesStatement:
+		return len(s.Sources) > 0
+	case *influxql.DropSeriesStatement:
+		return len(s.Sources) > 0
+	case *influxql.DropMeasurementStatement:
+		return true
+	}
+	return IsShowStatement(stmt) || IsAlterDatabaseStatement(stmt)
+}
+
+func IsShowStatement(stmt influxql.Statement) bool {
+	switch stmt.(type) {
+	case *influxql.ShowMeasurementsStatement, *influxql.ShowSeriesStatement, *influxql.ShowFieldKeysStatement,
+		*influxql.ShowTagKeysStatement, *influxql.ShowTagValuesStatement, *influxql.ShowRetentionPoliciesStatement,
+		*influxql.ShowStatsStatement, *influxql.ShowDatabasesStatement:
+		return true
+	}
+	return false
+}
+
+func IsAlterDatabaseStatement(stmt influxql.Statement) bool {
+	switch stmt.(type) {
+	case *influxql.CreateDatabaseStatement, *influxql.DropDatabaseStatement:
+		return true
+	}
+	return false
+}
+
+func IsDeleteOrDropStatement(stmt influxql.Statement) bool {
+	switch stmt.(type) {
+	case *influxql.DeleteSeriesStatement, *influxql.DropSeriesStatement, *influxql.DropMeasurementStatement:
+		return true
+	}
+	return false
+}
+
+// GetDatabaseFromStatement returns the database of the ON clause, or the first database qualifying a measurement
+func GetDatabaseFromStatement(stmt influxql.Statement) string {
+	switch s := stmt.(type) {
+	case *influxql.CreateDatabaseStatement:
+		return s.Name
+	case *influxql.DropDatabaseStatement:
+		return s.Name
+	case *influxql.AlterRetentionPolicyStatement:
+		return s.Database
+	case *influxql.CreateRetentionPolicyStatement:
+		return s.Database
+	case *influxql.DropRetentionPolicyStatement:
+		return s.Database
+	case *influxql.ShowRetentionPoliciesStatement:
+		return s.Database
+	case *influxql.CreateContinuousQueryStatement:
+		return s.Database
+	case *influxql.DropContinuousQueryStatement:
+		return s.Database
+	case *influxql.CreateSubscriptionStatement:
+		return s.Database
+	case *influxql.DropSubscriptionStatement:
+		return s.Database
+	case *influxql.GrantStatement:
+		return s.On
+	case *influxql.RevokeStatement:
+		return s.On
+	case *influxql.ShowMeasurementsStatement:
+		return s.Database
+	case *influxql.ShowMeasurementCardinalityStatement:
+		return s.Database
+	case *influxql.ShowSeriesStatement:
+		return s.Database
+	case *influxql.ShowSeriesCardinalityStatement:
+		return s.Database
+	case *influxql.ShowFieldKeysStatement:
+		return s.Database
+	case *influxql.ShowFieldKeyCardinalityStatement:
+		return s.Database
+	case *influxql.ShowTagKeysStatement:
+		return s.Database
+	case *influxql.ShowTagKeyCardinalityStatement:
+		return s.Database
+	case *influxql.ShowTagValuesStatement:
+		return s.Database
+	case *influxql.ShowTagValuesCardinalityStatement:
+		return s.Database
+	}
+	for _, m := range GetMeasurementsFromStatement(stmt) {
+		if m.Database != "" {
+			return m.Database
 		}
 	}
-	return "", ErrIllegalQL
-}
-
-func getDatabase(tokens []string) (m string) {
-	m = tokens[0]
-	if m[0] == '"' || m[0] == '\'' {
-		m = m[1 : len(m)-1]
-		return
-	}
-
-	index := strings.IndexByte(m, '.')
-	if index == -1 {
-		return
-	}
-
-	m = m[:index]
-	return
-}
-
-func getMeasurement(tokens []string) (m string) {
-	if len(tokens) >= 3 && (tokens[1] == "." || tokens[1] == "..") {
-		if len(tokens) >= 5 && tokens[3] == "." {
-			m = tokens[4]
-		} else {
-			m = tokens[2]
+	return ""
+}
+
+// GetMeasurementsFromStatement returns every measurement referenced by the statement, including those of subqueries
+func GetMeasurementsFromStatement(stmt influxql.Statement) []*influxql.Measurement {
+	switch s := stmt.(type) {
+	case *influxql.SelectStatement:
+		return getMeasurementsFromSources(s.Sources)
+	case *influxql.DeleteSeriesStatement:
+		return getMeasurementsFromSources(s.Sources)
+	case *influxql.DropSeriesStatement:
+		return getMeasurementsFromSources(s.Sources)
+	case *influxql.DropMeasurementStatement:
+		return []*influxql.Measurement{{Name: s.Name}}
+	case *influxql.ShowSeriesStatement:
+		return getMeasurementsFromSources(s.Sources)
+	case *influxql.ShowSeriesCardinalityStatement:
+		return getMeasurementsFromSources(s.Sources)
+	case *influxql.ShowMeasurementCardinalityStatement:
+		return getMeasurementsFromSources(s.Sources)
+	case *influxql.ShowFieldKeysStatement:
+		return getMeasurementsFromSources(s.Sources)
+	case *influxql.ShowFieldKeyCardinalityStatement:
+		return getMeasurementsFromSources(s.Sources)
+	case *influxql.ShowTagKeysStatement:
+		return getMeasurementsFromSources(s.Sources)
+	case *influxql.ShowTagKeyCardinalityStatement:
+		return getMeasurementsFromSources(s.Sources)
+	case *influxql.ShowTagValuesStatement:
+		return getMeasurementsFromSources(s.Sources)
+	case *influxql.ShowTagValuesCardinalityStatement:
+		return getMeasurementsFromSources(s.Sources)
+	}
+	return nil
+}
+
+func getMeasurementsFromSources(sources influxql.Sources) (measurements []*influxql.Measurement) {
+	for _, source := range sources {
+		switch s := source.(type) {
+		case *influxql.Measurement:
+			measurements = append(measurements, s)
+		case *influxql.SubQuery:
+			measurements = append(measurements, getMeasurementsFromSources(s.Statement.Sources)...)
 		}
-	} else {
-		m = tokens[0]
-	}
-
-	if m[0] == '/' {
-		return m
-	}
-
-	if m[0] == '"' || m[0] == '\'' {
-		m = m[1 : len(m)-1]
-		return
-	}
-
-	index := FindLastIndexWithIdent(m)
-	if index == -1 {
-		return
-	}
-
-	m = m[index+1:]
-	if m[0] == '"' || m[0] == '\'' {
-		m = strings.ReplaceAll(m[1:len(m)-1], `\"`, `"`)
 	}
 	return
 }
 
-func FindLastIndexWithIdent(m string) (i int) {
-	i = len(m) - 1
-	if m[i] == '"' || m[i] == '\'' {
-		for i = i - 1; i >= 0; i-- {
-			if m[i] == '"' || m[i] == '\'' {
-				if i > 0 && m[i-1] == '\\' {
-					i--
-				} else {
-					break
-				}
-			}
-		}
-		return i - 1
+// GetMeasurementName returns the name of the measurement, or the regex of the measurement like /cpu.*/
+func GetMeasurementName(m *influxql.Measurement) string {
+	if m.Regex != nil {
+		return m.Regex.String()
 	}
-	return strings.LastIndexByte(m, '.')
+	return m.Name
 }
 
-func CheckQuery(q string) (tokens []string, check bool, from bool) {
-	tokens = ScanTokens(q, 0)
-	stmt := strings.ToLower(tokens[0])
-	if stmt == "select" {
-		for i := 2; i < len(tokens); i++ {
-			stmt := strings.ToLower(tokens[i])
-			if stmt == "into" {
-				return tokens, false, false
-			}
-			if stmt == "from" {
-				return tokens, true, true
-			}
-		}
-		return tokens, false, false
-	}
-	if stmt == "show" {
-		for i := 2; i < len(tokens); i++ {
-			stmt := strings.ToLower(tokens[i])
-			if stmt == "from" {
-				check = SupportCmds[GetHeadStmtFromTokens(tokens, i)] || SupportCmds[GetHeadStmtFromTokens(tokens, i-2)]
-				return tokens, check, true
-			}
-		}
-	}
-	stmt2 := GetHeadStmtFromTokens(tokens, 2)
-	if SupportCmds[stmt2] {
-		return tokens, true, stmt2 == "delete from" || stmt2 == "drop measurement"
-	}
-	stmt3 := GetHeadStmtFromTokens(tokens, 3)
-	if SupportCmds[stmt3] {
-		return tokens, true, stmt3 == "drop series from"
+func GetDatabaseFromInfluxQL(q string) (string, error) {
+	stmt, err := ParseStatement(q, "")
+	if err != nil {
+		return "", err
 	}
-	return tokens, false, false
+	return GetDatabaseFromStatement(stmt), nil
 }
 
-func CheckDatabaseFromTokens(tokens []string) (check bool, show bool, alter bool, db string) {
-	stmt := GetHeadStmtFromTokens(tokens, 2)
-	show = stmt == "show databases"
-	alter = stmt == "create database" || stmt == "drop database"
-	check = show || alter
-	if alter && len(tokens) >= 3 {
-		db = getDatabase(tokens[2:])
+func GetMeasurementFromInfluxQL(q string) (string, error) {
+	stmt, err := ParseStatement(q, "")
+	if err != nil {
+		return "", err
 	}
-	return
-}
-
-func CheckSelectOrShowFromTokens(tokens []string) (check bool) {
-	stmt := strings.ToLower(tokens[0])
-	check = stmt == "select" || stmt == "show"
-	return
-}
-
-func CheckDeleteOrDropMeasurementFromTokens(tokens []string) (check bool) {
-	if len(tokens) >= 3 {
-		stmt := GetHeadStmtFromTokens(tokens, 2)
-		return stmt == "delete from" || stmt == "drop measurement" || stmt == "drop series"
+	measurements := GetMeasurementsFromStatement(stmt)
+	if len(measurements) == 0 {
+		return "", nil
 	}
-	return
+	return GetMeasurementName(measurements[0]), nil
 }
@@ -1,6 +1,9 @@
 package backend
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 // ALTER RETENTION POLICY "1h.cpu" ON "mydb" DEFAULT
 // ALTER RETENTION POLICY "policy1" ON "somedb" DURATION 1h REPLICATION 4
@@ -130,19 +133,26 @@ func TestGetMeasurementFromInfluxQL(t *testing.T) {
 	assertMeasurement(t, "DROP MEASUREMENT cpu;", "cpu")
 	assertMeasurement(t, "DROP MEASUREMENT \"cpu\"", "cpu")
 	assertMeasurement(t, "DROP SERIES FROM \"cpu\" WHERE cpu = 'cpu8'", "cpu")
-	assertMeasurement(t, "DROP SERIES FROM \"telegraf\"..\"cp u\" WHERE cpu = 'cpu8'", "cp u")
-	assertMeasurement(t, "DROP SERIES FROM \"telegraf\".\"autogen\".\"cp u\" WHERE cpu = 'cpu8'", "cp u")
+	assertMeasurement(t, "DROP SERIES FROM \"cp u\", mem WHERE cpu = 'cpu8'", "cp u")
+	assertParseError(t, "DROP SERIES FROM \"telegraf\"..\"cp u\" WHERE cpu = 'cpu8'", "database not supported")
+	assertParseError(t, "DROP SERIES FROM \"telegraf\".\"autogen\".\"cp u\" WHERE cpu = 'cpu8'", "retention policy not supported")
 
-	assertMeasurement(t, "REVOKE ALL PRIVILEGES FROM \"jdoe\"", "jdoe")
-	assertMeasurement(t, "REVOKE READ ON \"mydb\" FROM \"jdoe\"", "jdoe")
+	assertMeasurement(t, "REVOKE ALL PRIVILEGES FROM \"jdoe\"", "")
+	assertMeasurement(t, "REVOKE READ ON \"mydb\" FROM \"jdoe\"", "")
 
 	assertMeasurement(t, "select * from cpu", "cpu")
-	assertMeasurement(t, "(select *) from \"c.pu\"", "c.pu")
-	assertMeasurement(t, "[select *] from \"c,pu\"", "c,pu")
-	assertMeasurement(t, "{select *} from \"c pu\"", "c pu")
+	assertParseError(t, "(select *) from \"c.pu\"", "found (, expected SELECT")
+	assertParseError(t, "[select *] from \"c,pu\"", "found [, expected SELECT")
+	assertParseError(t, "{select *} from \"c pu\"", "found {, expected SELECT")
+	assertMeasurement(t, "select * from \"c.pu\"", "c.pu")
+	assertMeasurement(t, "select * from \"c,pu\"", "c,pu")
+	assertMeasurement(t, "select * from \"c pu\"", "c pu")
 	assertMeasurement(t, "select * from \"cpu\"", "cpu")
 	assertMeasurement(t, "select * from \"c\\\"pu\"", "c\"pu")
-	assertMeasurement(t, "select * from 'cpu'", "cpu")
+	assertParseError(t, "select * from 'cpu'", "found cpu, expected identifier")
+	assertMeasurement(t, "select * from /cpu.*/, mem", "/cpu.*/")
+	assertMeasurement(t, "select max(mean) from (select mean(value) from \"c pu\" group by time(1m))", "c pu")
+	assertMeasurement(t, "-- comment from mem\nselect * /* from mem */ from cpu", "cpu")
 	assertMeasurement(t, "select * from autogen.cpu", "cpu")
 	assertMeasurement(t, "select * from db..cpu", "cpu")
 	assertMeasurement(t, "select * from db.autogen.cpu", "cpu")
@@ -164,9 +174,10 @@ func TestGetMeasurementFromInfluxQL(t *testing.T) {
 	assertMeasurement(t, "SHOW FIELD KEYS", "")
 	assertMeasurement(t, "SHOW FIELD KEYS FROM \"cpu\"", "cpu")
 	assertMeasurement(t, "SHOW FIELD KEYS FROM \"1h\".\"cpu\"", "cpu")
-	assertMeasurement(t, "SHOW FIELD KEYS FROM 1h.cpu", "cpu")
+	assertParseError(t, "SHOW FIELD KEYS FROM 1h.cpu", "found 1h, expected identifier")
+	assertMeasurement(t, "SHOW FIELD KEYS FROM \"1h\".cpu", "cpu")
 	assertMeasurement(t, "SHOW FIELD KEYS FROM \"cpu.load\"", "cpu.load")
-	assertMeasurement(t, "SHOW FIELD KEYS FROM 1h.\"cpu.load\"", "cpu.load")
+	assertParseError(t, "SHOW FIELD KEYS FROM 1h.\"cpu.load\"", "found 1h, expected identifier")
 	assertMeasurement(t, "SHOW FIELD KEYS FROM \"1h\".\"cpu.load\"", "cpu.load")
 	assertMeasurement(t, "SHOW SERIES FROM \"cpu\" WHERE cpu = 'cpu8'", "cpu")
 	assertMeasurement(t, "SHOW SERIES FROM \"telegraf\"..\"cp.u\" WHERE cpu = 'cpu8'", "cp.u")
@@ -195,6 +206,73 @@ func assertMeasurement(t *testing.T, q string, m string) {
 	}
 }
 
+func assertParseError(t *testing.T, q string, e string) {
+	if _, err := GetMeasurementFromInfluxQL(q); err == nil || !strings.Contains(err.Error(), e) {
+		t.Errorf("parse error wrong: %s, %v != %s", q, err, e)
+	}
+}
+
+func TestCheckQuery(t *testing.T) {
+	tests := []struct {
+		q     string
+		check bool
+	}{
+		{"select * from cpu", true},
+		{"select * from (select * from cpu)", true},
+		{"select * from /cpu.*/, mem", true},
+		{"SELECT mean(\"value\") INTO \"cpu_1h\".:MEASUREMENT FROM /cpu.*/", false},
+		{"show measurements", true},
+		{"show series from cpu", true},
+		{"show field keys", true},
+		{"show tag keys from cpu", true},
+		{"show tag values with key = host", true},
+		{"show retention policies on mydb", true},
+		{"show stats", true},
+		{"show databases", true},
+		{"show users", false},
+		{"show series cardinality", false},
+		{"create database mydb", true},
+		{"drop database mydb", true},
+		{"delete from cpu", true},
+		{"delete where time < 0", false},
+		{"drop series from cpu", true},
+		{"drop series where host = 'a'", false},
+		{"drop measurement cpu", true},
+		{"create user jdoe with password 'pwd'", false},
+		{"drop shard 1", false},
+	}
+	for _, tt := range tests {
+		stmt, err := ParseStatement(tt.q, "")
+		if err != nil {
+			t.Errorf("error: %s, %s", tt.q, err)
+			continue
+		}
+		if check := CheckQuery(stmt); check != tt.check {
+			t.Errorf("check wrong: %s, %v != %v", tt.q, check, tt.check)
+		}
+	}
+
+	illegals := []string{
+		"(select *) from cpu",
+		"select * from 'cpu'",
+		"DROP SERIES FROM \"telegraf\"..\"cpu\"",
+		"select * from cpu; select * from mem",
+	}
+	for _, q := range illegals {
+		if _, err := ParseStatement(q, ""); err == nil {
+			t.Errorf("error expected: %s", q)
+		}
+	}
+}
+
+func TestGetDatabaseFromStatement(t *testing.T) {
+	assertDatabase(t, "select * from \"d.b\"..cpu", "d.b")
+	assertDatabase(t, "select * from cpu, db.autogen.mem", "db")
+	assertDatabase(t, "select * from (select * from db..cpu)", "db")
+	assertDatabase(t, "select * from cpu", "")
+	assertDatabase(t, "show tag keys on mydb from cpu", "mydb")
+}
+
 func BenchmarkGetDatabaseFromInfluxQL(b *testing.B) {
 	q := "CREATE SUBSCRIPTION \"sub0\" ON \"mydb\".\"autogen\" DESTINATIONS ALL 'udp://example.com:9090'"
 	for i := 0; i < b.N; i++ {
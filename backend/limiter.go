@@ -0,0 +1,60 @@
+package backend
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket holding at most one second of tokens, a request larger than
+// the bucket is allowed and paid back by the following requests
+type RateLimiter struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter of rate tokens per second, the rate <= 0 means unlimited
+func NewRateLimiter(rate int) *RateLimiter {
+	return &RateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (rl *RateLimiter) SetRate(rate int) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	rl.refill()
+	rl.rate = float64(rate)
+	if rl.tokens > rl.rate {
+		rl.tokens = rl.rate
+	}
+}
+
+func (rl *RateLimiter) Limited() bool {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	return rl.rate > 0
+}
+
+// Reserve takes n tokens and returns how long to wait until they are available
+func (rl *RateLimiter) Reserve(n int) time.Duration {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	if rl.rate <= 0 {
+		return 0
+	}
+	rl.refill()
+	rl.tokens -= float64(n)
+	if rl.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+}
+
+func (rl *RateLimiter) refill() {
+	now := time.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > rl.rate {
+		rl.tokens = rl.rate
+	}
+	rl.last = now
+}
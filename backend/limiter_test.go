@@ -0,0 +1,20 @@
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := NewRateLimiter(100)
+	if d := rl.Reserve(100); d != 0 {
+		t.Errorf("burst: got wait %s, want 0", d)
+	}
+	if d := rl.Reserve(50); d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Errorf("over rate: got wait %s, want about 500ms", d)
+	}
+	rl.SetRate(0)
+	if rl.Limited() || rl.Reserve(1000) != 0 {
+		t.Error("unlimited rate waits")
+	}
+}
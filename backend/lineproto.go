@@ -12,14 +12,25 @@ import (
 
 type LinePoint struct {
 	Db   string
+	Rp   string
 	Line []byte
+	Ack  *WriteAck
+	Sync *WalSync
 }
 
 func ScanKey(pointbuf []byte) (key string, err error) {
+	key, _, err = ScanKeyTags(pointbuf, nil)
+	return
+}
+
+// ScanKeyTags scans the measurement and the values of the given tag keys, a missing tag gets an empty value
+func ScanKeyTags(pointbuf []byte, tags []string) (key string, values []string, err error) {
 	buflen := len(pointbuf)
 	var b strings.Builder
 	b.Grow(buflen)
-	for i := 0; i < buflen; i++ {
+	i := 0
+Loop:
+	for ; i < buflen; i++ {
 		c := pointbuf[i]
 		switch c {
 		case '\\':
@@ -27,12 +38,51 @@ func ScanKey(pointbuf []byte) (key string, err error) {
 			b.WriteByte(pointbuf[i])
 		case ' ', ',':
 			key = b.String()
-			return
+			break Loop
 		default:
 			b.WriteByte(c)
 		}
 	}
-	return "", io.EOF
+	if i == buflen {
+		return "", nil, io.EOF
+	}
+	if len(tags) == 0 {
+		return
+	}
+
+	values = make([]string, len(tags))
+	for pointbuf[i] == ',' {
+		var tk, tv strings.Builder
+		cur := &tk
+		for i++; i < buflen; i++ {
+			c := pointbuf[i]
+			if c == '\\' && i+1 < buflen {
+				i++
+				cur.WriteByte(pointbuf[i])
+			} else if c == '=' && cur == &tk {
+				cur = &tv
+			} else if c == ',' || c == ' ' {
+				break
+			} else {
+				cur.WriteByte(c)
+			}
+		}
+		if i == buflen {
+			return "", nil, io.EOF
+		}
+		k := tk.String()
+		for j, tag := range tags {
+			if tag == k {
+				values[j] = tv.String()
+			}
+		}
+	}
+	return
+}
+
+func IsEmptyOrComment(line []byte) bool {
+	line = bytes.TrimSpace(line)
+	return len(line) == 0 || line[0] == '#'
 }
 
 func ScanTime(buf []byte) (int, bool) {
@@ -64,6 +64,58 @@ func TestScanKey(t *testing.T) {
 	}
 }
 
+func TestScanKeyTags(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   []byte
+		tags   []string
+		key    string
+		values []string
+	}{
+		{
+			name:   "test1",
+			line:   []byte("cpu,host=server01,region=us-west value=0.67 1596819659"),
+			tags:   []string{"host"},
+			key:    "cpu",
+			values: []string{"server01"},
+		},
+		{
+			name:   "test2",
+			line:   []byte("cpu,host=server01,region=us-west value=0.67 1596819659"),
+			tags:   []string{"region", "host"},
+			key:    "cpu",
+			values: []string{"us-west", "server01"},
+		},
+		{
+			name:   "test3",
+			line:   []byte("cpu,region=us-west value=0.67 1596819659"),
+			tags:   []string{"host"},
+			key:    "cpu",
+			values: []string{""},
+		},
+		{
+			name:   "test4",
+			line:   []byte("cpu value=0.67 1596819659"),
+			tags:   []string{"host"},
+			key:    "cpu",
+			values: []string{""},
+		},
+		{
+			name:   "test5",
+			line:   []byte("c\\ pu,ho\\=st=server\\,01,region=cn\\ north value=0.67 1596819659"),
+			tags:   []string{"ho=st", "region"},
+			key:    "c pu",
+			values: []string{"server,01", "cn north"},
+		},
+	}
+	for _, tt := range tests {
+		key, values, err := ScanKeyTags(tt.line, tt.tags)
+		if err != nil || key != tt.key || strings.Join(values, "|") != strings.Join(tt.values, "|") {
+			t.Errorf("%v: got %v %v, want %v %v", tt.name, key, values, tt.key, tt.values)
+		}
+	}
+}
+
 func BenchmarkScanKey(b *testing.B) {
 	buf := &bytes.Buffer{}
 	for i := 0; i < b.N; i++ {
@@ -0,0 +1,206 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb1-client/models"
+	"github.com/influxdata/influxql"
+)
+
+type MergeOptions struct {
+	Desc    bool
+	Limit   int
+	Offset  int
+	SLimit  int
+	SOffset int
+}
+
+// RewriteSelectForMerge returns the statement sent to each backend, offsets are moved from the backends
+// to the proxy, since they can only be applied after the series of all backends are merged
+func RewriteSelectForMerge(stmt *influxql.SelectStatement) (*influxql.SelectStatement, *MergeOptions) {
+	opts := &MergeOptions{
+		Desc:    !stmt.TimeAscending(),
+		Limit:   stmt.Limit,
+		Offset:  stmt.Offset,
+		SLimit:  stmt.SLimit,
+		SOffset: stmt.SOffset,
+	}
+	rstmt := stmt.Clone()
+	if rstmt.Limit > 0 {
+		rstmt.Limit += rstmt.Offset
+	}
+	rstmt.Offset = 0
+	if rstmt.SLimit > 0 {
+		rstmt.SLimit += rstmt.SOffset
+	}
+	rstmt.SOffset = 0
+	return rstmt, opts
+}
+
+func applyLimit(n, limit, offset int) (start, end int) {
+	if offset >= n {
+		return n, n
+	}
+	end = n
+	if limit > 0 && offset+limit < n {
+		end = offset + limit
+	}
+	return offset, end
+}
+
+// Apply applies the offsets and limits of the statement to the merged series
+func (opts *MergeOptions) Apply(rsp *Response) {
+	for _, result := range rsp.Results {
+		series := make(models.Rows, 0, len(result.Series))
+		for _, serie := range result.Series {
+			start, end := applyLimit(len(serie.Values), opts.Limit, opts.Offset)
+			if start == end {
+				continue
+			}
+			serie.Values = serie.Values[start:end]
+			series = append(series, serie)
+		}
+		start, end := applyLimit(len(series), opts.SLimit, opts.SOffset)
+		result.Series = series[start:end]
+	}
+}
+
+func seriesKey(serie *models.Row) string {
+	keys := make([]string, 0, len(serie.Tags))
+	for k := range serie.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(serie.Name)
+	for _, k := range keys {
+		b.WriteString(",")
+		b.WriteString(k)
+		b.WriteString("=")
+		b.WriteString(serie.Tags[k])
+	}
+	return b.String()
+}
+
+func timeOf(v interface{}) int64 {
+	switch t := v.(type) {
+	case json.Number:
+		n, _ := t.Int64()
+		return n
+	case string:
+		tm, _ := time.Parse(time.RFC3339Nano, t)
+		return tm.UnixNano()
+	case float64:
+		return int64(t)
+	case int64:
+		return t
+	}
+	return 0
+}
+
+// appendSerie appends the values of src to dst, and unions the columns if they differ
+func appendSerie(dst, src *models.Row) {
+	index := make(map[string]int, len(dst.Columns))
+	for i, c := range dst.Columns {
+		index[c] = i
+	}
+	mapping := make([]int, len(src.Columns))
+	same := len(src.Columns) == len(dst.Columns)
+	for i, c := range src.Columns {
+		j, ok := index[c]
+		if !ok {
+			j = len(dst.Columns)
+			dst.Columns = append(dst.Columns, c)
+			index[c] = j
+			for k := range dst.Values {
+				dst.Values[k] = append(dst.Values[k], nil)
+			}
+		}
+		mapping[i] = j
+		same = same && i == j
+	}
+	if same {
+		dst.Values = append(dst.Values, src.Values...)
+		return
+	}
+	for _, value := range src.Values {
+		v := make([]interface{}, len(dst.Columns))
+		for i, j := range mapping {
+			v[j] = value[i]
+		}
+		dst.Values = append(dst.Values, v)
+	}
+}
+
+func sortValuesByTime(values [][]interface{}, desc bool) {
+	sort.SliceStable(values, func(i, j int) bool {
+		if desc {
+			return timeOf(values[i][0]) > timeOf(values[j][0])
+		}
+		return timeOf(values[i][0]) < timeOf(values[j][0])
+	})
+}
+
+// dedupValues removes the values equal to a previous one of the same time from the sorted values,
+// the whole row is compared since the tags are columns of the values when the series are not grouped by them
+func dedupValues(values [][]interface{}) [][]interface{} {
+	if len(values) < 2 {
+		return values
+	}
+	n := 0
+	var seen map[string]bool
+	for i, value := range values {
+		if i == 0 || timeOf(value[0]) != timeOf(values[i-1][0]) {
+			seen = make(map[string]bool)
+		}
+		key := fmt.Sprint(value)
+		if !seen[key] {
+			seen[key] = true
+			values[n] = value
+			n++
+		}
+	}
+	return values[:n]
+}
+
+// mergeByTags merges the series with the same name and tags from all bodies, and sorts the values by time,
+// a point on several backends is kept once
+func mergeByTags(bodies [][]byte, desc bool) (rsp *Response, err error) {
+	var keys []string
+	seriesMap := make(map[string]*models.Row)
+	for _, b := range bodies {
+		results, err := ResultsFromResponseBytes(b)
+		if err != nil {
+			return nil, err
+		}
+		if len(results) == 0 {
+			continue
+		}
+		if results[0].Err != "" {
+			return nil, errors.New(results[0].Err)
+		}
+		for _, serie := range results[0].Series {
+			key := seriesKey(serie)
+			if s, ok := seriesMap[key]; ok {
+				appendSerie(s, serie)
+			} else {
+				seriesMap[key] = serie
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	series := make(models.Rows, 0, len(keys))
+	for _, key := range keys {
+		serie := seriesMap[key]
+		sortValuesByTime(serie.Values, desc)
+		serie.Values = dedupValues(serie.Values)
+		series = append(series, serie)
+	}
+	return ResponseFromSeries(series), nil
+}
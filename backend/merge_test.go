@@ -0,0 +1,123 @@
+package backend
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMergeByTags(t *testing.T) {
+	bodies := [][]byte{
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","value"],"values":[[1,1],[3,3]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"b"},"columns":["time","value"],"values":[[2,2]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","value","idle"],"values":[[2,2,5]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","value"],"values":[[3,3]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0}]}`),
+	}
+	rsp, err := mergeByTags(bodies, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := json.Marshal(rsp)
+	want := `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","value","idle"],"values":[[1,1,null],[2,2,5],[3,3,null]]},{"name":"cpu","tags":{"host":"b"},"columns":["time","value"],"values":[[2,2]]}]}]}`
+	if string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	rsp, err = mergeByTags(bodies[:1], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = json.Marshal(rsp)
+	want = `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","value"],"values":[[3,3],[1,1]]}]}]}`
+	if string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// the points of different tag values at the same time are kept when the tags are columns
+	rsp, err = mergeByTags([][]byte{
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","host","value"],"values":[[1,"a",1],[1,"b",1]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","host","value"],"values":[[1,"c",1],[1,"a",1]]}]}]}`),
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = json.Marshal(rsp)
+	want = `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","host","value"],"values":[[1,"a",1],[1,"b",1],[1,"c",1]]}]}]}`
+	if string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	_, err = mergeByTags([][]byte{[]byte(`{"results":[{"statement_id":0,"error":"bad query"}]}`)}, false)
+	if err == nil || err.Error() != "bad query" {
+		t.Errorf("got %v, want bad query", err)
+	}
+}
+
+func TestRewriteSelectForMerge(t *testing.T) {
+	tests := []struct {
+		q    string
+		want string
+		opts MergeOptions
+	}{
+		{
+			q:    "select * from cpu",
+			want: "SELECT * FROM cpu",
+			opts: MergeOptions{},
+		},
+		{
+			q:    "select value from cpu where host = 'a' group by host order by time desc limit 10 offset 5",
+			want: "SELECT value FROM cpu WHERE host = 'a' GROUP BY host ORDER BY time DESC LIMIT 15",
+			opts: MergeOptions{Desc: true, Limit: 10, Offset: 5},
+		},
+		{
+			q:    "select value from cpu group by * slimit 2 soffset 1",
+			want: "SELECT value FROM cpu GROUP BY * SLIMIT 3",
+			opts: MergeOptions{SLimit: 2, SOffset: 1},
+		},
+	}
+	for _, tt := range tests {
+		stmt, err := ParseSelectStatement(tt.q, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rstmt, opts := RewriteSelectForMerge(stmt)
+		if rstmt.String() != tt.want || *opts != tt.opts {
+			t.Errorf("%s: got %s %+v, want %s %+v", tt.q, rstmt, *opts, tt.want, tt.opts)
+		}
+	}
+}
+
+func TestMergeOptionsApply(t *testing.T) {
+	bodies := [][]byte{
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","value"],"values":[[1,1],[3,3],[5,5]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","value"],"values":[[2,2],[4,4]]},{"name":"cpu","tags":{"host":"b"},"columns":["time","value"],"values":[[1,1]]}]}]}`),
+	}
+	tests := []struct {
+		opts MergeOptions
+		want string
+	}{
+		{
+			opts: MergeOptions{Desc: true, Limit: 2, Offset: 1},
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","value"],"values":[[4,4],[3,3]]}]}]}`,
+		},
+		{
+			opts: MergeOptions{Limit: 2},
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","value"],"values":[[1,1],[2,2]]},{"name":"cpu","tags":{"host":"b"},"columns":["time","value"],"values":[[1,1]]}]}]}`,
+		},
+		{
+			opts: MergeOptions{SLimit: 1, SOffset: 1},
+			want: `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"b"},"columns":["time","value"],"values":[[1,1]]}]}]}`,
+		},
+	}
+	for _, tt := range tests {
+		rsp, err := mergeByTags(bodies, tt.opts.Desc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tt.opts.Apply(rsp)
+		got, _ := json.Marshal(rsp)
+		if string(got) != tt.want {
+			t.Errorf("%+v: got %s, want %s", tt.opts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package backend
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "influx_proxy"
+
+// otherDB is the db label of the databases not in db list
+const otherDB = "other"
+
+var (
+	PointsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "points_received_total",
+		Help:      "Number of points received by /write, by db in db list or other.",
+	}, []string{"db"})
+	PointsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "points_rejected_total",
+		Help:      "Number of malformed points rejected by /write, by db in db list or other.",
+	}, []string{"db"})
+	PointsFlushed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "points_flushed_total",
+		Help:      "Number of points flushed from the backend buffers, by result (written, spooled or dropped).",
+	}, []string{"backend", "result"})
+	FlushDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "flush_duration_seconds",
+		Help:      "Latency of compressed writes to the backend.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend"})
+	SpoolBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "spool_bytes_total",
+		Help:      "Number of bytes spooled to the backend data file.",
+	}, []string{"backend"})
+	SpoolPendingBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "spool_pending_bytes",
+		Help:      "Number of spooled bytes not rewritten to the backend yet.",
+	}, []string{"backend"})
+	SpoolDroppedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "spool_dropped_bytes_total",
+		Help:      "Number of spooled bytes dropped by the spool limits, by reason (rejected, oldest, expired, corrupted or purged).",
+	}, []string{"backend", "reason"})
+	RewriteBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rewrite_bytes_total",
+		Help:      "Number of spooled bytes rewritten to the backend.",
+	}, []string{"backend"})
+	RewriteErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rewrite_errors_total",
+		Help:      "Number of failed rewrites of spooled data.",
+	}, []string{"backend"})
+	BackendActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "backend_active",
+		Help:      "Whether the backend is active (1) or not (0).",
+	}, []string{"backend"})
+	BackendRewriting = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "backend_rewriting",
+		Help:      "Whether the backend is rewriting spooled data (1) or not (0).",
+	}, []string{"backend"})
+	BackendBreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "backend_breaker_state",
+		Help:      "State of the backend circuit breaker, closed (0), half-open (1) or open (2).",
+	}, []string{"backend"})
+	QueryHedges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "query_hedges_total",
+		Help:      "Number of hedged queries, by the backend which answered first.",
+	}, []string{"backend"})
+	QueryCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "query_cache_requests_total",
+		Help:      "Number of selects looked up in the query cache, by result (hit, miss or bypass).",
+	}, []string{"result"})
+	QueryCacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "query_cache_bytes",
+		Help:      "Bytes of results held by the query cache.",
+	})
+	QueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "query_duration_seconds",
+		Help:      "Latency of /query by execution path (select, show, delete_drop or alter).",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"path"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		PointsReceived,
+		PointsRejected,
+		PointsFlushed,
+		FlushDuration,
+		SpoolBytes,
+		SpoolPendingBytes,
+		SpoolDroppedBytes,
+		RewriteBytes,
+		RewriteErrors,
+		BackendActive,
+		BackendRewriting,
+		BackendBreakerState,
+		QueryHedges,
+		QueryCacheRequests,
+		QueryCacheBytes,
+		QueryDuration,
+	)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func observeQueryDuration(path string, start time.Time) {
+	QueryDuration.WithLabelValues(path).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,80 @@
+package backend
+
+import (
+	"math/rand"
+	"sort"
+)
+
+const (
+	ReadPolicyRandom           = "random"
+	ReadPolicyPreferred        = "preferred"
+	ReadPolicyLeastOutstanding = "least-outstanding"
+	ReadPolicyEWMALatency      = "ewma-latency"
+)
+
+// ReadPolicy orders the circles to read from, the circles are tried in order until one answers,
+// key is the db and measurement of the query, or empty when the query reads all backends of a circle
+type ReadPolicy interface {
+	Order(circles []*Circle, key string) []int
+}
+
+func NewReadPolicy(cfg *ProxyConfig) ReadPolicy {
+	switch cfg.ReadPolicy {
+	case ReadPolicyPreferred:
+		return &preferredPolicy{names: cfg.PreferredCircles}
+	case ReadPolicyLeastOutstanding:
+		return &loadPolicy{load: func(be *Backend) float64 { return float64(be.OutstandingQueries()) }}
+	case ReadPolicyEWMALatency:
+		return &loadPolicy{load: func(be *Backend) float64 { return be.QueryLatency() }}
+	default:
+		return &randomPolicy{}
+	}
+}
+
+type randomPolicy struct{}
+
+func (p *randomPolicy) Order(circles []*Circle, key string) []int {
+	return rand.Perm(len(circles))
+}
+
+// preferredPolicy reads from the circles in the order of names first, and the others randomly
+type preferredPolicy struct {
+	names []string
+}
+
+func (p *preferredPolicy) Order(circles []*Circle, key string) []int {
+	rank := make(map[string]int, len(p.names))
+	for i, name := range p.names {
+		rank[name] = i + 1
+	}
+	order := rand.Perm(len(circles))
+	sort.SliceStable(order, func(i, j int) bool {
+		ri, rj := rank[circles[order[i]].Name], rank[circles[order[j]].Name]
+		return ri != 0 && (rj == 0 || ri < rj)
+	})
+	return order
+}
+
+// loadPolicy reads from the circle whose backend of key has the lowest load first, the load of a circle
+// is the sum of its backends when key is empty, the circles with the same load are ordered randomly
+type loadPolicy struct {
+	load func(be *Backend) float64
+}
+
+func (p *loadPolicy) Order(circles []*Circle, key string) []int {
+	loads := make([]float64, len(circles))
+	for i, circle := range circles {
+		if key != "" {
+			loads[i] = p.load(circle.GetBackend(key))
+			continue
+		}
+		for _, be := range circle.Backends {
+			loads[i] += p.load(be)
+		}
+	}
+	order := rand.Perm(len(circles))
+	sort.SliceStable(order, func(i, j int) bool {
+		return loads[order[i]] < loads[order[j]]
+	})
+	return order
+}
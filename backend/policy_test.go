@@ -0,0 +1,43 @@
+package backend
+
+import "testing"
+
+func TestReadPolicyPreferred(t *testing.T) {
+	circles := newTestCircles(3)
+	policy := NewReadPolicy(&ProxyConfig{ReadPolicy: ReadPolicyPreferred, PreferredCircles: []string{"circle-3", "circle-1"}})
+	for i := 0; i < 10; i++ {
+		if order := policy.Order(circles, "db,cpu"); order[0] != 2 || order[1] != 0 || order[2] != 1 {
+			t.Fatalf("order: got %v", order)
+		}
+	}
+}
+
+func TestReadPolicyLoad(t *testing.T) {
+	circles := newTestCircles(3)
+	circles[0].Backends[0].outstanding = 2
+	circles[2].Backends[0].outstanding = 1
+	policy := NewReadPolicy(&ProxyConfig{ReadPolicy: ReadPolicyLeastOutstanding})
+	if order := policy.Order(circles, "db,cpu"); order[0] != 1 || order[1] != 2 || order[2] != 0 {
+		t.Errorf("least-outstanding order: got %v", order)
+	}
+
+	circles[0].Backends[0].latency = 0.1
+	circles[1].Backends[0].latency = 0.3
+	circles[2].Backends[0].latency = 0.2
+	policy = NewReadPolicy(&ProxyConfig{ReadPolicy: ReadPolicyEWMALatency})
+	if order := policy.Order(circles, ""); order[0] != 0 || order[1] != 2 || order[2] != 1 {
+		t.Errorf("ewma-latency order: got %v", order)
+	}
+}
+
+func TestQueryLatency(t *testing.T) {
+	hb := NewSimpleHttpBackend(&BackendConfig{Name: "latency"})
+	hb.beginQuery()(&QueryResult{Err: ErrCircuitOpen})
+	if hb.QueryLatency() != 0 || hb.OutstandingQueries() != 0 {
+		t.Errorf("failed query: got latency %f, outstanding %d", hb.QueryLatency(), hb.OutstandingQueries())
+	}
+	hb.beginQuery()(&QueryResult{Status: 200})
+	if hb.QueryLatency() <= 0 {
+		t.Error("completed query: latency not updated")
+	}
+}
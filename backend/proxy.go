@@ -1,7 +1,9 @@
 package backend
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -12,6 +14,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/influxdata/influxql"
 	"github.com/tixff/influx-proxy/util"
 )
 
@@ -20,18 +23,75 @@ var (
 	ErrDatabaseNotFound    = errors.New("database not found")
 	ErrBackendsUnavailable = errors.New("backends unavailable")
 	ErrGetMeasurement      = errors.New("can't get measurement")
+	ErrNotExecuted         = errors.New("not executed")
 	ErrGetBackends         = errors.New("can't get backends")
+	ErrMergeAggregate      = errors.New("unsupported aggregate query across backends")
+	ErrMissingMeasurement  = errors.New("missing measurement")
+	ErrMissingFields       = errors.New("missing fields")
+	ErrInvalidLineFormat   = errors.New("invalid line format")
+	ErrWalFailed           = errors.New("wal write failed")
+)
+
+const MaxLineErrors = 100
+
+type LineError struct {
+	Line   int    `json:"line"`
+	Text   string `json:"text"`
+	Reason string `json:"reason"`
+}
+
+type PartialWriteError struct {
+	Dropped int
+	Lines   []*LineError
+}
+
+func (e *PartialWriteError) Error() string {
+	var b strings.Builder
+	b.WriteString("partial write: ")
+	for i, le := range e.Lines {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "unable to parse '%s' (line %d): %s", le.Text, le.Line, le.Reason)
+	}
+	if e.Dropped > len(e.Lines) {
+		fmt.Fprintf(&b, "\nand %d more lines", e.Dropped-len(e.Lines))
+	}
+	fmt.Fprintf(&b, " dropped=%d", e.Dropped)
+	return b.String()
+}
+
+const (
+	QueryModeSingle = "single"
+	QueryModeMerge  = "merge"
 )
 
 type Proxy struct {
-	Circles []*Circle
-	DBSet   util.Set
+	Circles    []*Circle
+	DBSet      util.Set
+	ShardTags  ShardTags
+	QueryMode  string
+	HedgeDelay time.Duration
+	ReadPolicy ReadPolicy
+	Cache      *QueryCache
+	WALEnabled bool
+	// user is the user of the query on a view, show databases returns only the databases the user can read
+	user *User
+	lock sync.RWMutex
+	// tlock guards the topology of circles, held to route a query or a point but not while it is in flight
+	tlock sync.RWMutex
 }
 
 func NewProxy(cfg *ProxyConfig) (ip *Proxy) {
 	ip = &Proxy{
-		Circles: make([]*Circle, len(cfg.Circles)),
-		DBSet:   util.NewSet(),
+		Circles:    make([]*Circle, len(cfg.Circles)),
+		DBSet:      util.NewSet(),
+		ShardTags:  cfg.ShardTags,
+		QueryMode:  cfg.QueryMode,
+		HedgeDelay: time.Duration(cfg.HedgeDelay) * time.Millisecond,
+		ReadPolicy: NewReadPolicy(cfg),
+		Cache:      NewQueryCache(cfg),
+		WALEnabled: cfg.WALEnabled,
 	}
 	for idx, circfg := range cfg.Circles {
 		ip.Circles[idx] = NewCircle(circfg, cfg, idx)
@@ -43,6 +103,118 @@ func NewProxy(cfg *ProxyConfig) (ip *Proxy) {
 	return
 }
 
+// Reload applies the safe settings of cfg to the proxy and its backends
+func (ip *Proxy) Reload(cfg *ProxyConfig) {
+	ip.lock.Lock()
+	ip.DBSet = util.NewSetFromSlice(cfg.DBList)
+	ip.QueryMode = cfg.QueryMode
+	ip.HedgeDelay = time.Duration(cfg.HedgeDelay) * time.Millisecond
+	ip.ReadPolicy = NewReadPolicy(cfg)
+	ip.lock.Unlock()
+	ip.Cache.Reload(cfg)
+	ip.tlock.RLock()
+	defer ip.tlock.RUnlock()
+	for _, circle := range ip.Circles {
+		for _, be := range circle.Backends {
+			be.Reload(cfg)
+		}
+	}
+}
+
+// Close closes all backends and waits for them to drain, the points not written when ctx
+// is done are spooled to the files
+func (ip *Proxy) Close(ctx context.Context) {
+	// a write getting into a closed backend is refused by the backend, so tlock is only held to list the backends
+	ip.tlock.RLock()
+	var backends []*Backend
+	for _, circle := range ip.Circles {
+		backends = append(backends, circle.Backends...)
+	}
+	ip.tlock.RUnlock()
+	var wg sync.WaitGroup
+	for _, be := range backends {
+		wg.Add(1)
+		go func(be *Backend) {
+			defer wg.Done()
+			be.Close()
+		}(be)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("backends not drained before deadline, spool the rest")
+		for _, be := range backends {
+			be.SpoolAll()
+		}
+		<-done
+	}
+}
+
+// snapshot returns a view of the proxy whose circles are not changed by the topology changes,
+// so that a query in flight does not hold tlock
+func (ip *Proxy) snapshot() *Proxy {
+	ip.lock.RLock()
+	view := &Proxy{
+		DBSet:      ip.DBSet,
+		ShardTags:  ip.ShardTags,
+		QueryMode:  ip.QueryMode,
+		HedgeDelay: ip.HedgeDelay,
+		ReadPolicy: ip.ReadPolicy,
+		Cache:      ip.Cache,
+		WALEnabled: ip.WALEnabled,
+	}
+	ip.lock.RUnlock()
+	ip.tlock.RLock()
+	defer ip.tlock.RUnlock()
+	view.Circles = make([]*Circle, len(ip.Circles))
+	for i, circle := range ip.Circles {
+		view.Circles[i] = circle.snapshot()
+	}
+	return view
+}
+
+func (ip *Proxy) AllowDB(db string) bool {
+	ip.lock.RLock()
+	defer ip.lock.RUnlock()
+	return len(ip.DBSet) == 0 || ip.DBSet[db]
+}
+
+// metricDB returns the db label of the metrics, the databases not in db list share the other label,
+// so that the clients can not grow the label values
+func (ip *Proxy) metricDB(db string) string {
+	ip.lock.RLock()
+	defer ip.lock.RUnlock()
+	if ip.DBSet[db] {
+		return db
+	}
+	return otherDB
+}
+
+func (ip *Proxy) GetQueryMode() string {
+	ip.lock.RLock()
+	defer ip.lock.RUnlock()
+	return ip.QueryMode
+}
+
+// ReadOrder returns the ids of circles in the order to read the data of key
+func (ip *Proxy) ReadOrder(key string) []int {
+	ip.lock.RLock()
+	policy := ip.ReadPolicy
+	ip.lock.RUnlock()
+	return policy.Order(ip.Circles, key)
+}
+
+func (ip *Proxy) GetHedgeDelay() time.Duration {
+	ip.lock.RLock()
+	defer ip.lock.RUnlock()
+	return ip.HedgeDelay
+}
+
 func GetKey(db, meas string) string {
 	var b strings.Builder
 	b.Grow(len(db) + len(meas) + 1)
@@ -52,6 +224,27 @@ func GetKey(db, meas string) string {
 	return b.String()
 }
 
+// ReplicaKey returns the key routing the points of the measurement with the tag values,
+// ok is false if the measurement is sharded and a value of its shard tags is not given
+func (ip *Proxy) ReplicaKey(db, meas string, tags map[string]string) (key string, ok bool) {
+	shardTags := ip.ShardTags.Get(db, meas)
+	if len(shardTags) == 0 {
+		return GetKey(db, meas), true
+	}
+	values := make([]string, len(shardTags))
+	for i, tag := range shardTags {
+		if values[i], ok = tags[tag]; !ok {
+			return "", false
+		}
+	}
+	return GetShardKey(db, meas, shardTags, values), true
+}
+
+// GetCircles returns a snapshot of the circles which is not changed by the topology changes
+func (ip *Proxy) GetCircles() []*Circle {
+	return ip.snapshot().Circles
+}
+
 func (ip *Proxy) GetBackends(key string) []*Backend {
 	backends := make([]*Backend, len(ip.Circles))
 	for i, circle := range ip.Circles {
@@ -61,9 +254,11 @@ func (ip *Proxy) GetBackends(key string) []*Backend {
 }
 
 func (ip *Proxy) GetHealth(stats bool) []interface{} {
+	// the stats of the backends are queried on a snapshot without holding tlock
+	circles := ip.snapshot().Circles
 	var wg sync.WaitGroup
-	health := make([]interface{}, len(ip.Circles))
-	for i, c := range ip.Circles {
+	health := make([]interface{}, len(circles))
+	for i, c := range circles {
 		wg.Add(1)
 		go func(i int, c *Circle) {
 			defer wg.Done()
@@ -74,90 +269,302 @@ func (ip *Proxy) GetHealth(stats bool) []interface{} {
 	return health
 }
 
-func (ip *Proxy) Query(w http.ResponseWriter, req *http.Request) (body []byte, err error) {
+func (ip *Proxy) GetBacklog() []interface{} {
+	ip.tlock.RLock()
+	defer ip.tlock.RUnlock()
+	backlog := make([]interface{}, len(ip.Circles))
+	for i, c := range ip.Circles {
+		backends := make([]interface{}, len(c.Backends))
+		for j, be := range c.Backends {
+			backends[j] = be.GetBacklog()
+		}
+		circle := struct {
+			Id   int    `json:"id"` // nolint:golint
+			Name string `json:"name"`
+		}{c.CircleId, c.Name}
+		backlog[i] = struct {
+			Circle   interface{} `json:"circle"`
+			Backends interface{} `json:"backends"`
+		}{circle, backends}
+	}
+	return backlog
+}
+
+func (ip *Proxy) FindBackend(circleId int, name string) (*Backend, error) { // nolint:golint
+	ip.tlock.RLock()
+	defer ip.tlock.RUnlock()
+	if circleId < 0 || circleId >= len(ip.Circles) {
+		return nil, ErrCircleNotFound
+	}
+	for _, be := range ip.Circles[circleId].Backends {
+		if be.Name == name {
+			return be, nil
+		}
+	}
+	return nil, ErrBackendNotFound
+}
+
+// Query returns the body of the response, or nil when the chunked response has been written to w,
+// the statements are executed only if the user is authorized to execute all of them
+func (ip *Proxy) Query(w http.ResponseWriter, req *http.Request, user *User) (body []byte, err error) {
 	q := strings.TrimSpace(req.FormValue("q"))
 	if q == "" {
 		return nil, ErrEmptyQuery
 	}
 
-	tokens, check, from := CheckQuery(q)
-	if !check {
+	query, err := ParseQuery(q, req.FormValue("params"))
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range query.Statements {
+		if err = user.Authorize(stmt, req.FormValue("db")); err != nil {
+			return nil, err
+		}
+	}
+	if len(query.Statements) == 0 {
+		return nil, ErrEmptyQuery
+	}
+	view := ip.snapshot()
+	view.user = user
+	if len(query.Statements) > 1 {
+		return view.QueryStatements(w, req, query.Statements)
+	}
+	return view.QueryStatement(w, req, query.Statements[0])
+}
+
+// QueryStatements routes each statement independently, and assembles the results into one unchunked response
+func (ip *Proxy) QueryStatements(w http.ResponseWriter, req *http.Request, stmts influxql.Statements) (body []byte, err error) {
+	header := make(http.Header)
+	results := make([]*Result, 0, len(stmts))
+	var failed bool
+	for i, stmt := range stmts {
+		if failed {
+			results = append(results, &Result{StatementID: i, Err: ErrNotExecuted.Error()})
+			continue
+		}
+		cr := CloneQueryRequest(req)
+		cr.Form.Set("q", stmt.String())
+		cr.Form.Del("params")
+		cr.Form.Del("chunked")
+		hr := &headerRecorder{header: make(http.Header)}
+		rsp, err := ip.queryStatementResponse(hr, cr, stmt)
+		if err != nil {
+			failed = true
+			results = append(results, &Result{StatementID: i, Err: err.Error()})
+			continue
+		}
+		CopyHeader(header, hr.header)
+		for _, result := range rsp.Results {
+			result.StatementID = i
+			failed = failed || result.Err != ""
+			results = append(results, result)
+		}
+	}
+	header.Del("Content-Encoding")
+	header.Del("Content-Length")
+	CopyHeader(w.Header(), header)
+	pretty := req.URL.Query().Get("pretty") == "true"
+	return util.MarshalJSON(ResponseFromResults(results), pretty), nil
+}
+
+func (ip *Proxy) queryStatementResponse(hr *headerRecorder, req *http.Request, stmt influxql.Statement) (*Response, error) {
+	body, err := ip.QueryStatement(hr, req, stmt)
+	if err != nil {
+		return nil, err
+	}
+	if hr.header.Get("Content-Encoding") == "gzip" {
+		body, err = GzipDecompress(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rsp, err := ResponseFromResponseBytes(body)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.Err != "" {
+		return nil, errors.New(rsp.Err)
+	}
+	return rsp, nil
+}
+
+func (ip *Proxy) QueryStatement(w http.ResponseWriter, req *http.Request, stmt influxql.Statement) (body []byte, err error) {
+	if !CheckQuery(stmt) {
 		return nil, ErrIllegalQL
 	}
 
-	checkDb, showDb, alterDb, db := CheckDatabaseFromTokens(tokens)
-	if !checkDb {
+	showDb := false
+	var db string
+	switch stmt.(type) {
+	case *influxql.ShowDatabasesStatement:
+		showDb = true
+	case *influxql.CreateDatabaseStatement, *influxql.DropDatabaseStatement:
+		db = GetDatabaseFromStatement(stmt)
+	default:
 		db = req.FormValue("db")
 		if db == "" {
-			db, _ = GetDatabaseFromTokens(tokens)
+			db = GetDatabaseFromStatement(stmt)
 		}
 	}
 	if !showDb {
 		if db == "" {
 			return nil, ErrDatabaseNotFound
 		}
-		if len(ip.DBSet) > 0 && !ip.DBSet[db] {
+		for _, m := range GetMeasurementsFromStatement(stmt) {
+			if m.Database != "" && !ip.AllowDB(m.Database) {
+				return nil, fmt.Errorf("database forbidden: %s", m.Database)
+			}
+		}
+		if !ip.AllowDB(db) {
 			return nil, fmt.Errorf("database forbidden: %s", db)
 		}
 	}
 
-	selectOrShow := CheckSelectOrShowFromTokens(tokens)
-	if selectOrShow && from {
-		return QueryFromQL(w, req, ip, tokens, db)
-	} else if selectOrShow && !from {
-		return QueryShowQL(w, req, ip, tokens)
-	} else if CheckDeleteOrDropMeasurementFromTokens(tokens) {
-		return QueryDeleteOrDropQL(w, req, ip, tokens, db)
-	} else if alterDb {
+	start := time.Now()
+	if _, ok := stmt.(*influxql.SelectStatement); ok || IsShowStatement(stmt) && len(GetMeasurementsFromStatement(stmt)) > 0 {
+		defer observeQueryDuration("select", start)
+		return ip.Cache.Query(w, req, stmt, db, func() ([]byte, error) {
+			return QueryFromQL(w, req, ip, stmt, db)
+		})
+	} else if IsShowStatement(stmt) {
+		defer observeQueryDuration("show", start)
+		return QueryShowQL(w, req, ip, stmt)
+	} else if IsDeleteOrDropStatement(stmt) {
+		defer observeQueryDuration("delete_drop", start)
+		defer ip.Cache.Invalidate(db, GetMeasurementsFromStatement(stmt))
+		return QueryDeleteOrDropQL(w, req, ip, stmt, db)
+	} else if IsAlterDatabaseStatement(stmt) {
+		defer observeQueryDuration("alter", start)
+		defer ip.Cache.InvalidateDB(db)
 		return QueryAlterQL(w, req, ip)
 	}
 	return nil, ErrIllegalQL
 }
 
-func (ip *Proxy) Write(p []byte, db, precision string) (err error) {
-	buf := bytes.NewBuffer(p)
+// Write reads the body line by line, and dispatches the points to the backends as they are parsed
+func (ip *Proxy) Write(body io.Reader, db, rp, precision, consistency string) (err error) {
+	var ack *WriteAck
+	var ws *WalSync
+	if consistency != "" && consistency != ConsistencyAny {
+		ack = NewWriteAck()
+	} else if ip.WALEnabled {
+		// the points are acknowledged once synced to the wal
+		ws = NewWalSync()
+	}
+	var perr *PartialWriteError
+	var points int
+	var readErr error
+	reader := bufio.NewReaderSize(body, 64*1024)
 	var line []byte
-	for {
-		line, err = buf.ReadBytes('\n')
-		switch err {
-		default:
-			log.Printf("error: %s", err)
-			return
-		case io.EOF, nil:
-			err = nil
+	for lineno := 1; ; lineno++ {
+		line, readErr = reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			log.Printf("read body error: %s", readErr)
+			break
 		}
 		if len(line) == 0 {
 			break
 		}
-		ip.WriteRow(line, db, precision)
+		if IsEmptyOrComment(line) {
+			continue
+		}
+		rerr := ip.WriteRow(line, db, rp, precision, ack, ws)
+		if rerr == nil {
+			points++
+		} else {
+			if perr == nil {
+				perr = &PartialWriteError{}
+			}
+			perr.Dropped++
+			if len(perr.Lines) < MaxLineErrors {
+				perr.Lines = append(perr.Lines, &LineError{Line: lineno, Text: string(bytes.TrimSpace(line)), Reason: rerr.Error()})
+			}
+		}
+	}
+	label := ip.metricDB(db)
+	PointsReceived.WithLabelValues(label).Add(float64(points))
+	if perr != nil {
+		PointsRejected.WithLabelValues(label).Add(float64(perr.Dropped))
+	}
+	if readErr != nil && readErr != io.EOF {
+		return readErr
+	}
+	if ws != nil {
+		for be := range ws.backends {
+			be.WritePoint(&LinePoint{Db: db, Rp: rp, Sync: ws})
+		}
+		ws.Wait()
+		if ws.Failed() {
+			return ErrWalFailed
+		}
+	}
+	if ack != nil {
+		for _, be := range ack.backends() {
+			be.WritePoint(&LinePoint{Db: db, Rp: rp, Ack: ack})
+		}
+		ack.Wait()
+		ip.tlock.RLock()
+		circles := ip.Circles
+		ip.tlock.RUnlock()
+		err = ack.Check(circles, consistency)
+		if err != nil {
+			return
+		}
+	}
+	if perr != nil {
+		return perr
 	}
 	return
 }
 
-func (ip *Proxy) WriteRow(line []byte, db, precision string) {
+func (ip *Proxy) WriteRow(line []byte, db, rp, precision string, ack *WriteAck, ws *WalSync) (err error) {
 	nanoLine := AppendNano(line, precision)
 	meas, err := ScanKey(nanoLine)
 	if err != nil {
 		log.Printf("scan key error: %s", err)
-		return
+		return ErrInvalidLineFormat
+	}
+	if meas == "" {
+		log.Printf("invalid format, drop data: %s %s %s", db, precision, string(line))
+		return ErrMissingMeasurement
 	}
 	if !RapidCheck(nanoLine[len(meas):]) {
 		log.Printf("invalid format, drop data: %s %s %s", db, precision, string(line))
-		return
+		return ErrMissingFields
 	}
 
 	key := GetKey(db, meas)
+	if tags := ip.ShardTags.Get(db, meas); len(tags) > 0 {
+		_, values, err := ScanKeyTags(nanoLine, tags)
+		if err != nil {
+			log.Printf("scan tags error: %s", err)
+			return ErrInvalidLineFormat
+		}
+		key = GetShardKey(db, meas, tags, values)
+	}
+	// tlock is held until the point is queued, so that no point gets into a removed backend
+	ip.tlock.RLock()
+	defer ip.tlock.RUnlock()
 	backends := ip.GetBackends(key)
 	if len(backends) == 0 {
 		log.Printf("write data error: can't get backends")
-		return
+		return ErrGetBackends
 	}
 
-	point := &LinePoint{db, nanoLine}
-	for _, be := range backends {
-		err := be.WritePoint(point)
-		if err != nil {
+	point := &LinePoint{Db: db, Rp: rp, Line: nanoLine, Ack: ack, Sync: ws}
+	for i, be := range backends {
+		if ack != nil {
+			ack.touch(be, ip.Circles[i])
+		}
+		if ws != nil {
+			ws.touch(be)
+		}
+		if err := be.WritePoint(point); err != nil {
+			if ack != nil {
+				ack.fail(be, err)
+			}
 			log.Printf("write data to buffer error: %s, %s, %s, %s, %s", err, be.Url, db, precision, string(line))
 		}
 	}
+	return
 }
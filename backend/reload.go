@@ -0,0 +1,124 @@
+package backend
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// ConfigDiff lists the changes applied live by a reload, and the changes refused which require a restart
+type ConfigDiff struct {
+	Applied []string `json:"applied"`
+	Refused []string `json:"refused"`
+}
+
+func (diff *ConfigDiff) Changed() bool {
+	return len(diff.Applied) > 0 || len(diff.Refused) > 0
+}
+
+// MergeConfig returns a copy of cfg with the safe changes of ncfg applied, the topology of circles
+// and the settings bound at startup are kept, and their changes are refused in the diff
+func MergeConfig(cfg, ncfg *ProxyConfig) (mcfg *ProxyConfig, diff *ConfigDiff) {
+	c := *cfg
+	mcfg = &c
+	diff = &ConfigDiff{Applied: []string{}, Refused: []string{}}
+	apply := func(name string, dst, src interface{}, secret bool) {
+		dv, sv := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src)
+		if reflect.DeepEqual(dv.Interface(), sv.Interface()) {
+			return
+		}
+		if secret {
+			diff.Applied = append(diff.Applied, fmt.Sprintf("%s changed", name))
+		} else {
+			diff.Applied = append(diff.Applied, fmt.Sprintf("%s changed from %v to %v", name, dv.Interface(), sv.Interface()))
+		}
+		dv.Set(sv)
+	}
+	refuse := func(name string, old, new interface{}) {
+		if !reflect.DeepEqual(old, new) {
+			diff.Refused = append(diff.Refused, fmt.Sprintf("%s changed from %v to %v, restart required", name, old, new))
+		}
+	}
+
+	apply("db_list", &mcfg.DBList, ncfg.DBList, false)
+	apply("query_mode", &mcfg.QueryMode, ncfg.QueryMode, false)
+	apply("hedge_delay", &mcfg.HedgeDelay, ncfg.HedgeDelay, false)
+	apply("read_policy", &mcfg.ReadPolicy, ncfg.ReadPolicy, false)
+	apply("preferred_circles", &mcfg.PreferredCircles, ncfg.PreferredCircles, false)
+	apply("query_cache_ttl", &mcfg.QueryCacheTTL, ncfg.QueryCacheTTL, false)
+	apply("query_cache_max_size", &mcfg.QueryCacheMaxSize, ncfg.QueryCacheMaxSize, false)
+	apply("query_cache_min_window", &mcfg.QueryCacheMinWindow, ncfg.QueryCacheMinWindow, false)
+	apply("flush_size", &mcfg.FlushSize, ncfg.FlushSize, false)
+	apply("flush_time", &mcfg.FlushTime, ncfg.FlushTime, false)
+	apply("check_interval", &mcfg.CheckInterval, ncfg.CheckInterval, false)
+	apply("rewrite_interval", &mcfg.RewriteInterval, ncfg.RewriteInterval, false)
+	apply("rewrite_concurrency", &mcfg.RewriteConcurrency, ncfg.RewriteConcurrency, false)
+	apply("rewrite_rate_limit", &mcfg.RewriteRateLimit, ncfg.RewriteRateLimit, false)
+	apply("rewrite_points_limit", &mcfg.RewritePointsLimit, ncfg.RewritePointsLimit, false)
+	apply("write_timeout", &mcfg.WriteTimeout, ncfg.WriteTimeout, false)
+	apply("write_consistency", &mcfg.WriteConsistency, ncfg.WriteConsistency, false)
+	apply("max_body_size", &mcfg.MaxBodySize, ncfg.MaxBodySize, false)
+	apply("breaker_enabled", &mcfg.BreakerEnabled, ncfg.BreakerEnabled, false)
+	apply("breaker_window", &mcfg.BreakerWindow, ncfg.BreakerWindow, false)
+	apply("breaker_min_requests", &mcfg.BreakerMinRequests, ncfg.BreakerMinRequests, false)
+	apply("breaker_failure_rate", &mcfg.BreakerFailureRate, ncfg.BreakerFailureRate, false)
+	apply("breaker_slow_threshold", &mcfg.BreakerSlowThreshold, ncfg.BreakerSlowThreshold, false)
+	apply("breaker_open_timeout", &mcfg.BreakerOpenTimeout, ncfg.BreakerOpenTimeout, false)
+	apply("username", &mcfg.Username, ncfg.Username, true)
+	apply("password", &mcfg.Password, ncfg.Password, true)
+	apply("auth_encrypt", &mcfg.AuthEncrypt, ncfg.AuthEncrypt, false)
+	apply("users", &mcfg.Users, ncfg.Users, true)
+	apply("write_tracing", &mcfg.WriteTracing, ncfg.WriteTracing, false)
+	apply("query_tracing", &mcfg.QueryTracing, ncfg.QueryTracing, false)
+
+	diff.Refused = append(diff.Refused, diffCircles(cfg.Circles, ncfg.Circles)...)
+	refuse("hash_key", cfg.HashKey, ncfg.HashKey)
+	refuse("shard_tags", cfg.ShardTags, ncfg.ShardTags)
+	refuse("listen_addr", cfg.ListenAddr, ncfg.ListenAddr)
+	refuse("data_dir", cfg.DataDir, ncfg.DataDir)
+	refuse("wal_enabled", cfg.WALEnabled, ncfg.WALEnabled)
+	refuse("spool_segment_size", cfg.SpoolSegmentSize, ncfg.SpoolSegmentSize)
+	refuse("spool_max_size", cfg.SpoolMaxSize, ncfg.SpoolMaxSize)
+	refuse("spool_max_age", cfg.SpoolMaxAge, ncfg.SpoolMaxAge)
+	refuse("spool_policy", cfg.SpoolPolicy, ncfg.SpoolPolicy)
+	refuse("tlog_dir", cfg.TLogDir, ncfg.TLogDir)
+	refuse("conn_pool_size", cfg.ConnPoolSize, ncfg.ConnPoolSize)
+	refuse("idle_timeout", cfg.IdleTimeout, ncfg.IdleTimeout)
+	refuse("shutdown_timeout", cfg.ShutdownTimeout, ncfg.ShutdownTimeout)
+	refuse("https_enabled", cfg.HTTPSEnabled, ncfg.HTTPSEnabled)
+	refuse("https_cert", cfg.HTTPSCert, ncfg.HTTPSCert)
+	refuse("https_key", cfg.HTTPSKey, ncfg.HTTPSKey)
+	return
+}
+
+func diffCircles(circles, ncircles []*CircleConfig) (diff []string) {
+	add := func(format string, a ...interface{}) {
+		diff = append(diff, fmt.Sprintf(format, a...)+", restart required")
+	}
+	for i := len(circles); i < len(ncircles); i++ {
+		add("circle %d (%s): added with %d backends", i, ncircles[i].Name, len(ncircles[i].Backends))
+	}
+	for i := len(ncircles); i < len(circles); i++ {
+		add("circle %d (%s): removed", i, circles[i].Name)
+	}
+	for i := 0; i < len(circles) && i < len(ncircles); i++ {
+		c, nc := circles[i], ncircles[i]
+		if c.Name != nc.Name {
+			add("circle %d: name changed from %s to %s", i, c.Name, nc.Name)
+		}
+		for j := len(c.Backends); j < len(nc.Backends); j++ {
+			add("circle %d (%s): backend %s (%s) added", i, nc.Name, nc.Backends[j].Name, nc.Backends[j].Url)
+		}
+		for j := len(nc.Backends); j < len(c.Backends); j++ {
+			add("circle %d (%s): backend %s (%s) removed", i, c.Name, c.Backends[j].Name, c.Backends[j].Url)
+		}
+		for j := 0; j < len(c.Backends) && j < len(nc.Backends); j++ {
+			b, nb := c.Backends[j], nc.Backends[j]
+			if b.Name != nb.Name || b.Url != nb.Url {
+				add("circle %d (%s): backend %d changed from %s (%s) to %s (%s)", i, c.Name, j, b.Name, b.Url, nb.Name, nb.Url)
+			} else if b.Username != nb.Username || b.Password != nb.Password || b.AuthEncrypt != nb.AuthEncrypt {
+				add("circle %d (%s): backend %s auth changed", i, c.Name, b.Name)
+			}
+		}
+	}
+	return
+}
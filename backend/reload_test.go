@@ -0,0 +1,49 @@
+package backend
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeConfig(t *testing.T) {
+	cfg := newTestProxyConfig(t)
+	cfg.DBList = []string{"db1"}
+	cfg.Password = "secret"
+	ncfg := cfg.cloneCircles()
+	ncfg.DBList = []string{"db1", "db2"}
+	ncfg.FlushSize = 500
+	ncfg.Password = "changed"
+	ncfg.HashKey = "name"
+	ncfg.Circles[0].Backends = append(ncfg.Circles[0].Backends, &BackendConfig{Name: "b2", Url: "http://127.0.0.1:8087"})
+
+	mcfg, diff := MergeConfig(cfg, ncfg)
+	applied := []string{
+		"db_list changed from [db1] to [db1 db2]",
+		"flush_size changed from 10000 to 500",
+		"password changed",
+	}
+	refused := []string{
+		"circle 0 (circle-1): backend b2 (http://127.0.0.1:8087) added, restart required",
+		"hash_key changed from idx to name, restart required",
+	}
+	if !reflect.DeepEqual(diff.Applied, applied) {
+		t.Errorf("applied: got %v, want %v", diff.Applied, applied)
+	}
+	if !reflect.DeepEqual(diff.Refused, refused) {
+		t.Errorf("refused: got %v, want %v", diff.Refused, refused)
+	}
+	if mcfg.FlushSize != 500 || mcfg.Password != "changed" || len(mcfg.DBList) != 2 {
+		t.Errorf("safe changes not applied: %+v", mcfg)
+	}
+	if mcfg.HashKey != "idx" || len(mcfg.Circles[0].Backends) != 1 {
+		t.Errorf("refused changes applied: %+v", mcfg)
+	}
+	if cfg.FlushSize != 10000 {
+		t.Errorf("original config modified: %+v", cfg)
+	}
+
+	_, diff = MergeConfig(cfg, cfg.cloneCircles())
+	if diff.Changed() {
+		t.Errorf("unexpected diff: %+v", diff)
+	}
+}
@@ -84,3 +84,50 @@ func ResponseFromError(err string) (rsp *Response) {
 	}
 	return
 }
+
+const DefaultChunkSize = 10000
+
+// Chunks splits the response into responses with at most chunkSize values per series like chunked responses of influxdb,
+// in which partial marks that the series or the result continues in the next chunk
+func (rsp *Response) Chunks(chunkSize int) (chunks []*Response) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	for _, result := range rsp.Results {
+		var rows models.Rows
+		for _, serie := range result.Series {
+			for start := 0; ; start += chunkSize {
+				end := start + chunkSize
+				if end > len(serie.Values) {
+					end = len(serie.Values)
+				}
+				rows = append(rows, &models.Row{
+					Name:    serie.Name,
+					Tags:    serie.Tags,
+					Columns: serie.Columns,
+					Values:  serie.Values[start:end],
+					Partial: end < len(serie.Values),
+				})
+				if end == len(serie.Values) {
+					break
+				}
+			}
+		}
+		if len(rows) == 0 {
+			chunks = append(chunks, ResponseFromResults([]*Result{result}))
+			continue
+		}
+		for i, row := range rows {
+			r := &Result{StatementID: result.StatementID, Series: models.Rows{row}, Partial: i < len(rows)-1}
+			if i == len(rows)-1 {
+				r.Messages = result.Messages
+				r.Err = result.Err
+			}
+			chunks = append(chunks, ResponseFromResults([]*Result{r}))
+		}
+	}
+	if rsp.Err != "" {
+		chunks = append(chunks, ResponseFromError(rsp.Err))
+	}
+	return
+}
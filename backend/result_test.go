@@ -0,0 +1,31 @@
+package backend
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestResponseChunks(t *testing.T) {
+	b := []byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[1,1],[2,2],[3,3]]},{"name":"mem","columns":["time","value"],"values":[[1,1]]}]},{"statement_id":1}],"error":"1/2 backends unavailable"}`)
+	rsp, err := ResponseFromResponseBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[1,1],[2,2]],"partial":true}],"partial":true}]}`,
+		`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[3,3]]}],"partial":true}]}`,
+		`{"results":[{"statement_id":0,"series":[{"name":"mem","columns":["time","value"],"values":[[1,1]]}]}]}`,
+		`{"results":[{"statement_id":1}]}`,
+		`{"error":"1/2 backends unavailable"}`,
+	}
+	chunks := rsp.Chunks(2)
+	if len(chunks) != len(want) {
+		t.Fatalf("got %d chunks, want %d", len(chunks), len(want))
+	}
+	for i, chunk := range chunks {
+		got, _ := json.Marshal(chunk)
+		if string(got) != want[i] {
+			t.Errorf("chunk %d: got %s, want %s", i, got, want[i])
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package backend
+
+import (
+	"strings"
+)
+
+// ShardTags maps database -> measurement -> tag keys used to shard points of the measurement across backends
+type ShardTags map[string]map[string][]string
+
+func (st ShardTags) Get(db, meas string) []string {
+	if ms, ok := st[db]; ok {
+		return ms[meas]
+	}
+	return nil
+}
+
+func (st ShardTags) IsSharded(db, meas string) bool {
+	return len(st.Get(db, meas)) > 0
+}
+
+func GetShardKey(db, meas string, tags, values []string) string {
+	var b strings.Builder
+	b.WriteString(db)
+	b.WriteString(",")
+	b.WriteString(meas)
+	for i, tag := range tags {
+		b.WriteString(",")
+		b.WriteString(tag)
+		b.WriteString("=")
+		b.WriteString(values[i])
+	}
+	return b.String()
+}
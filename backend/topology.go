@@ -0,0 +1,176 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrCircleNotFound  = errors.New("circle not found")
+	ErrBackendNotFound = errors.New("backend not found")
+	ErrLastCircle      = errors.New("cannot remove the last circle")
+	ErrLastBackend     = errors.New("cannot remove the last backend of a circle")
+)
+
+// cloneCircles returns a copy of cfg whose circles can be changed without touching cfg
+func (cfg *ProxyConfig) cloneCircles() *ProxyConfig {
+	c := *cfg
+	c.Circles = make([]*CircleConfig, len(cfg.Circles))
+	for i, circfg := range cfg.Circles {
+		cc := *circfg
+		cc.Backends = append([]*BackendConfig(nil), circfg.Backends...)
+		c.Circles[i] = &cc
+	}
+	return &c
+}
+
+func (cfg *ProxyConfig) checkCircleId(circleId int) error { // nolint:golint
+	if circleId < 0 || circleId >= len(cfg.Circles) {
+		return ErrCircleNotFound
+	}
+	return nil
+}
+
+// WithBackend returns a checked copy of cfg with the backend appended to the circle
+func (cfg *ProxyConfig) WithBackend(circleId int, bkcfg *BackendConfig) (*ProxyConfig, error) { // nolint:golint
+	if err := cfg.checkCircleId(circleId); err != nil {
+		return nil, err
+	}
+	ncfg := cfg.cloneCircles()
+	circfg := ncfg.Circles[circleId]
+	circfg.Backends = append(circfg.Backends, bkcfg)
+	return ncfg, ncfg.checkConfig()
+}
+
+// WithoutBackend returns a checked copy of cfg with the backend removed from the circle
+func (cfg *ProxyConfig) WithoutBackend(circleId int, name string) (*ProxyConfig, *BackendConfig, error) { // nolint:golint
+	if err := cfg.checkCircleId(circleId); err != nil {
+		return nil, nil, err
+	}
+	ncfg := cfg.cloneCircles()
+	circfg := ncfg.Circles[circleId]
+	for i, bkcfg := range circfg.Backends {
+		if bkcfg.Name == name {
+			if len(circfg.Backends) == 1 {
+				return nil, nil, ErrLastBackend
+			}
+			circfg.Backends = append(circfg.Backends[:i], circfg.Backends[i+1:]...)
+			return ncfg, bkcfg, ncfg.checkConfig()
+		}
+	}
+	return nil, nil, ErrBackendNotFound
+}
+
+// WithCircle returns a checked copy of cfg with the circle appended
+func (cfg *ProxyConfig) WithCircle(circfg *CircleConfig) (*ProxyConfig, error) {
+	ncfg := cfg.cloneCircles()
+	ncfg.Circles = append(ncfg.Circles, circfg)
+	return ncfg, ncfg.checkConfig()
+}
+
+// WithoutCircle returns a checked copy of cfg with the circle removed
+func (cfg *ProxyConfig) WithoutCircle(circleId int) (*ProxyConfig, error) { // nolint:golint
+	if err := cfg.checkCircleId(circleId); err != nil {
+		return nil, err
+	}
+	if len(cfg.Circles) == 1 {
+		return nil, ErrLastCircle
+	}
+	ncfg := cfg.cloneCircles()
+	ncfg.Circles = append(ncfg.Circles[:circleId], ncfg.Circles[circleId+1:]...)
+	return ncfg, ncfg.checkConfig()
+}
+
+// AddBackend starts a backend and appends it to the circle, the router of the circle is rebuilt
+// when no query or write is in flight
+func (ip *Proxy) AddBackend(circleId int, bkcfg *BackendConfig, pxcfg *ProxyConfig) *Backend { // nolint:golint
+	be := NewBackend(bkcfg, pxcfg)
+	ip.tlock.Lock()
+	defer ip.tlock.Unlock()
+	circle := ip.Circles[circleId]
+	backends := append(append([]*Backend(nil), circle.Backends...), be)
+	circle.SetBackends(backends)
+	return be
+}
+
+// RemoveBackend removes the backend from the circle and closes it, a backend with backlog data
+// to rewrite is only removed when force is set
+func (ip *Proxy) RemoveBackend(circleId int, name string, force bool) (err error) { // nolint:golint
+	removed, err := ip.removeBackend(circleId, name, force)
+	if err != nil {
+		return
+	}
+	// the removed backend is flushed after tlock is released, so that the writes and queries are not stalled
+	removed.Close()
+	return
+}
+
+func (ip *Proxy) removeBackend(circleId int, name string, force bool) (*Backend, error) { // nolint:golint
+	ip.tlock.Lock()
+	defer ip.tlock.Unlock()
+	if circleId < 0 || circleId >= len(ip.Circles) {
+		return nil, ErrCircleNotFound
+	}
+	circle := ip.Circles[circleId]
+	var backends []*Backend
+	var removed *Backend
+	for _, be := range circle.Backends {
+		if be.Name == name {
+			removed = be
+		} else {
+			backends = append(backends, be)
+		}
+	}
+	if removed == nil {
+		return nil, ErrBackendNotFound
+	}
+	if !force && removed.fb.IsData() {
+		return nil, fmt.Errorf("backend %s has backlog data to rewrite", name)
+	}
+	circle.SetBackends(backends)
+	return removed, nil
+}
+
+// AddCircle starts a circle with its backends and appends it to the proxy
+func (ip *Proxy) AddCircle(circfg *CircleConfig, pxcfg *ProxyConfig) *Circle {
+	ip.tlock.Lock()
+	defer ip.tlock.Unlock()
+	circle := NewCircle(circfg, pxcfg, len(ip.Circles))
+	ip.Circles = append(append([]*Circle(nil), ip.Circles...), circle)
+	return circle
+}
+
+// RemoveCircle removes the circle from the proxy and closes its backends, the ids of the
+// following circles are shifted down, a circle with backlog data to rewrite is only removed when force is set
+func (ip *Proxy) RemoveCircle(circleId int, force bool) (err error) { // nolint:golint
+	removed, err := ip.removeCircle(circleId, force)
+	if err != nil {
+		return
+	}
+	for _, be := range removed.Backends {
+		be.Close()
+	}
+	return
+}
+
+func (ip *Proxy) removeCircle(circleId int, force bool) (*Circle, error) { // nolint:golint
+	ip.tlock.Lock()
+	defer ip.tlock.Unlock()
+	if circleId < 0 || circleId >= len(ip.Circles) {
+		return nil, ErrCircleNotFound
+	}
+	removed := ip.Circles[circleId]
+	if !force {
+		for _, be := range removed.Backends {
+			if be.fb.IsData() {
+				return nil, fmt.Errorf("backend %s of circle %s has backlog data to rewrite", be.Name, removed.Name)
+			}
+		}
+	}
+	circles := append(append([]*Circle(nil), ip.Circles[:circleId]...), ip.Circles[circleId+1:]...)
+	for idx, circle := range circles {
+		circle.CircleId = idx
+	}
+	ip.Circles = circles
+	return removed, nil
+}
@@ -0,0 +1,138 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCircleSetBackends(t *testing.T) {
+	circle := &Circle{hashKey: "name"}
+	b1, b2 := NewSimpleBackend(&BackendConfig{Name: "b1"}), NewSimpleBackend(&BackendConfig{Name: "b2"})
+	circle.SetBackends([]*Backend{b1, b2})
+	routed := make(map[*Backend]int)
+	for i := 0; i < 100; i++ {
+		routed[circle.GetBackend(fmt.Sprintf("db,cpu%d", i))]++
+	}
+	if routed[b1] == 0 || routed[b2] == 0 {
+		t.Fatalf("keys not spread across backends: %v", routed)
+	}
+
+	circle.SetBackends([]*Backend{b1})
+	for i := 0; i < 100; i++ {
+		if be := circle.GetBackend(fmt.Sprintf("db,cpu%d", i)); be != b1 {
+			t.Fatalf("key cpu%d routed to %s after b2 removed", i, be.Name)
+		}
+	}
+}
+
+func TestConfigTopology(t *testing.T) {
+	cfg := newTestProxyConfig(t)
+	ncfg, err := cfg.WithBackend(0, &BackendConfig{Name: "b2", Url: "http://127.0.0.1:8087"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ncfg.Circles[0].Backends) != 2 || len(cfg.Circles[0].Backends) != 1 {
+		t.Errorf("backend not added to a copy: %d, %d", len(ncfg.Circles[0].Backends), len(cfg.Circles[0].Backends))
+	}
+	if _, err = ncfg.WithBackend(0, &BackendConfig{Name: "b1"}); err != ErrDuplicatedBackendName {
+		t.Errorf("duplicated backend: got %v", err)
+	}
+	if _, err = ncfg.WithBackend(1, &BackendConfig{Name: "b3"}); err != ErrCircleNotFound {
+		t.Errorf("circle not found: got %v", err)
+	}
+
+	rcfg, bkcfg, err := ncfg.WithoutBackend(0, "b1")
+	if err != nil || bkcfg.Name != "b1" || len(rcfg.Circles[0].Backends) != 1 || rcfg.Circles[0].Backends[0].Name != "b2" {
+		t.Errorf("backend not removed: %v", err)
+	}
+	if _, _, err = rcfg.WithoutBackend(0, "b2"); err != ErrLastBackend {
+		t.Errorf("last backend: got %v", err)
+	}
+	if _, _, err = ncfg.WithoutBackend(0, "b3"); err != ErrBackendNotFound {
+		t.Errorf("backend not found: got %v", err)
+	}
+
+	ccfg, err := cfg.WithCircle(&CircleConfig{Name: "circle-2", Backends: []*BackendConfig{{Name: "b2"}}})
+	if err != nil || len(ccfg.Circles) != 2 {
+		t.Errorf("circle not added: %v", err)
+	}
+	if _, err = cfg.WithCircle(&CircleConfig{Name: "circle-2"}); err != ErrEmptyBackends {
+		t.Errorf("empty circle: got %v", err)
+	}
+	if _, err = cfg.WithoutCircle(0); err != ErrLastCircle {
+		t.Errorf("last circle: got %v", err)
+	}
+	if rcfg, err = ccfg.WithoutCircle(0); err != nil || len(rcfg.Circles) != 1 || rcfg.Circles[0].Name != "circle-2" {
+		t.Errorf("circle not removed: %v", err)
+	}
+}
+
+func TestTopologyChangeDuringWrite(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+	cfg := newTestProxyConfig(t)
+	cfg.Circles = []*CircleConfig{{Name: "circle-1", Backends: []*BackendConfig{{Name: "b1", Url: ts.URL}}}}
+	ip := NewProxy(cfg)
+	defer ip.Close(context.Background())
+
+	// the body of the write is still being read while the backends are changed
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- ip.Write(pr, "db", "", "ns", ConsistencyAll)
+	}()
+	pw.Write([]byte("cpu value=1\n"))
+	changed := make(chan struct{})
+	go func() {
+		ip.AddBackend(0, &BackendConfig{Name: "b2", Url: ts.URL}, cfg)
+		ip.RemoveBackend(0, "b1", true)
+		close(changed)
+	}()
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("topology change blocked by the write in flight")
+	}
+	pw.Write([]byte("cpu value=2\n"))
+	pw.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("write: got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write not acknowledged after the backend removed")
+	}
+}
+
+func TestRemoveCircleBacklog(t *testing.T) {
+	cfg := newTestProxyConfig(t)
+	cfg.Circles = append(cfg.Circles, &CircleConfig{Name: "circle-2", Backends: []*BackendConfig{{Name: "b2", Url: "http://127.0.0.1:1"}}})
+	ip := NewProxy(cfg)
+	defer ip.Close(context.Background())
+	ip.Circles[1].Backends[0].fb.Write([]byte("cpu value=1 1\n"))
+
+	tests := []struct {
+		circleId int
+		force    bool
+		err      bool
+		circles  int
+	}{
+		{2, true, true, 2},
+		{1, false, true, 2},
+		{1, true, false, 1},
+	}
+	for _, tt := range tests {
+		err := ip.RemoveCircle(tt.circleId, tt.force)
+		if (err != nil) != tt.err || len(ip.Circles) != tt.circles {
+			t.Errorf("remove circle %d force %v: got %v, %d circles", tt.circleId, tt.force, err, len(ip.Circles))
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package backend
+
+import (
+	"fmt"
+
+	"github.com/influxdata/influxql"
+	"github.com/tixff/influx-proxy/util"
+)
+
+const (
+	PrivilegeRead  = "read"
+	PrivilegeWrite = "write"
+	PrivilegeAll   = "all"
+)
+
+// User is an authenticated user, an admin has all privileges on all databases and the admin endpoints
+type User struct {
+	Name       string
+	Admin      bool
+	privileges map[string]influxql.Privilege
+}
+
+type AuthorizationError struct {
+	User      string
+	Statement string
+	Privilege influxql.ExecutionPrivilege
+}
+
+func (e *AuthorizationError) Error() string {
+	requires := "admin privilege"
+	if !e.Privilege.Admin {
+		requires = fmt.Sprintf("%s on %s", e.Privilege.Privilege, e.Privilege.Name)
+	}
+	if e.Statement == "" {
+		return fmt.Sprintf("user %q not authorized, requires %s", e.User, requires)
+	}
+	return fmt.Sprintf("user %q not authorized to execute statement '%s', requires %s", e.User, e.Statement, requires)
+}
+
+func (u *User) authorize(ep influxql.ExecutionPrivilege) bool {
+	switch {
+	case u.Admin:
+		return true
+	case ep.Admin:
+		return false
+	case ep.Privilege == influxql.NoPrivileges:
+		return true
+	}
+	p := u.privileges[ep.Name]
+	return p == influxql.AllPrivileges || p == ep.Privilege
+}
+
+// AuthorizeAdmin returns an error if the user is not an admin
+func (u *User) AuthorizeAdmin() error {
+	if !u.Admin {
+		return &AuthorizationError{User: u.Name, Privilege: influxql.ExecutionPrivilege{Admin: true}}
+	}
+	return nil
+}
+
+// AuthorizeDB returns an error if the user has not the privilege p on db
+func (u *User) AuthorizeDB(db string, p influxql.Privilege) error {
+	ep := influxql.ExecutionPrivilege{Name: db, Privilege: p}
+	if !u.authorize(ep) {
+		return &AuthorizationError{User: u.Name, Privilege: ep}
+	}
+	return nil
+}
+
+// Authorize returns an error if the user has not the privileges required by the statement,
+// the privileges on the database not named by the statement are required on db
+func (u *User) Authorize(stmt influxql.Statement, db string) error {
+	eps, err := stmt.RequiredPrivileges()
+	if err != nil {
+		return err
+	}
+	for _, ep := range eps {
+		if ep.Name == "" {
+			ep.Name = db
+		}
+		if !u.authorize(ep) {
+			return &AuthorizationError{User: u.Name, Statement: stmt.String(), Privilege: ep}
+		}
+	}
+	return nil
+}
+
+// Users authenticates the users of the config, the username and password of the config is an admin,
+// and everyone is an admin if no user is configured
+type Users struct {
+	users   map[string]*userEntry
+	encrypt bool
+}
+
+type userEntry struct {
+	password string
+	user     *User
+}
+
+func NewUsers(cfg *ProxyConfig) *Users {
+	us := &Users{users: make(map[string]*userEntry), encrypt: cfg.AuthEncrypt}
+	if cfg.Username != "" || cfg.Password != "" {
+		us.users[cfg.Username] = &userEntry{password: cfg.Password, user: &User{Name: us.decrypt(cfg.Username), Admin: true}}
+	}
+	for _, ucfg := range cfg.Users {
+		user := &User{Name: us.decrypt(ucfg.Username), Admin: ucfg.Admin, privileges: make(map[string]influxql.Privilege)}
+		for db, p := range ucfg.Privileges {
+			user.privileges[db] = parsePrivilege(p)
+		}
+		us.users[ucfg.Username] = &userEntry{password: ucfg.Password, user: user}
+	}
+	return us
+}
+
+func parsePrivilege(p string) influxql.Privilege {
+	switch p {
+	case PrivilegeRead:
+		return influxql.ReadPrivilege
+	case PrivilegeWrite:
+		return influxql.WritePrivilege
+	case PrivilegeAll:
+		return influxql.AllPrivileges
+	}
+	return influxql.NoPrivileges
+}
+
+func (us *Users) Enabled() bool {
+	return len(us.users) > 0
+}
+
+// Authenticate returns the user of username and password, or nil if authentication fails
+func (us *Users) Authenticate(username, password string) *User {
+	if !us.Enabled() {
+		return &User{Admin: true}
+	}
+	if us.encrypt {
+		username, password = util.AesEncrypt(username), util.AesEncrypt(password)
+	}
+	if entry, ok := us.users[username]; ok && entry.password == password {
+		return entry.user
+	}
+	return nil
+}
+
+func (us *Users) decrypt(text string) string {
+	if us.encrypt {
+		return util.AesDecrypt(text)
+	}
+	return text
+}
@@ -0,0 +1,100 @@
+package backend
+
+import (
+	"testing"
+
+	"github.com/influxdata/influxql"
+)
+
+func TestUsersAuthenticate(t *testing.T) {
+	us := NewUsers(&ProxyConfig{})
+	if user := us.Authenticate("", ""); user == nil || !user.Admin {
+		t.Errorf("auth disabled: got %+v", user)
+	}
+
+	us = NewUsers(&ProxyConfig{Username: "admin", Password: "secret", Users: []*UserConfig{{Username: "bob", Password: "pass"}}})
+	if user := us.Authenticate("admin", "secret"); user == nil || !user.Admin {
+		t.Errorf("admin: got %+v", user)
+	}
+	if user := us.Authenticate("bob", "pass"); user == nil || user.Admin || user.Name != "bob" {
+		t.Errorf("bob: got %+v", user)
+	}
+	if us.Authenticate("bob", "secret") != nil || us.Authenticate("alice", "pass") != nil {
+		t.Error("authenticated with wrong username or password")
+	}
+}
+
+func TestUserAuthorize(t *testing.T) {
+	us := NewUsers(&ProxyConfig{Users: []*UserConfig{
+		{Username: "bob", Password: "pass", Privileges: map[string]string{"db1": PrivilegeRead, "db2": PrivilegeWrite, "db3": PrivilegeAll}},
+	}})
+	user := us.Authenticate("bob", "pass")
+	tests := []struct {
+		q    string
+		db   string
+		want bool
+	}{
+		{"select * from cpu", "db1", true},
+		{"select * from cpu", "db2", false},
+		{"select * from cpu", "db3", true},
+		{"select * from db2.autogen.cpu", "db1", false},
+		{"select * from cpu; select * from mem", "db1", true},
+		{"show measurements", "db1", true},
+		{"show databases", "", true},
+		{"delete from cpu", "db1", false},
+		{"delete from cpu", "db2", true},
+		{"drop series from cpu", "db3", true},
+		{"drop measurement cpu", "db3", false},
+		{"create database db4", "", false},
+		{"drop database db3", "", false},
+	}
+	for _, tt := range tests {
+		query, err := ParseQuery(tt.q, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, stmt := range query.Statements {
+			err = user.Authorize(stmt, tt.db)
+			if _, ok := err.(*AuthorizationError); (err == nil) != tt.want || err != nil && !ok {
+				t.Errorf("%s on %s: got %v", tt.q, tt.db, err)
+			}
+		}
+	}
+
+	if user.AuthorizeDB("db1", influxql.WritePrivilege) == nil || user.AuthorizeDB("db2", influxql.WritePrivilege) != nil {
+		t.Error("write privileges not authorized")
+	}
+	if user.AuthorizeAdmin() == nil {
+		t.Error("non-admin authorized as admin")
+	}
+}
+
+func TestReduceDatabases(t *testing.T) {
+	us := NewUsers(&ProxyConfig{Username: "admin", Users: []*UserConfig{
+		{Username: "bob", Password: "pass", Privileges: map[string]string{"db1": PrivilegeRead, "db2": PrivilegeWrite, "db3": PrivilegeAll}},
+	}})
+	body := []byte(`{"results":[{"statement_id":0,"series":[{"name":"databases","columns":["name"],"values":[["db1"],["db2"],["db3"],["db4"]]}]}]}`)
+	tests := []struct {
+		user *User
+		want int
+	}{
+		{nil, 4},
+		{us.Authenticate("admin", ""), 4},
+		{us.Authenticate("bob", "pass"), 2},
+	}
+	for _, tt := range tests {
+		rsp, err := reduceDatabases(tt.user)([][]byte{body})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []interface{}
+		for _, serie := range rsp.Results[0].Series {
+			for _, value := range serie.Values {
+				got = append(got, value[0])
+			}
+		}
+		if len(got) != tt.want {
+			t.Errorf("user %+v: got %v", tt.user, got)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package backend
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// WriteAheadLog keeps the points of each buffer in a segment file until the buffer is written
+// or spooled, the segments left by a crash are replayed into the spool on startup
+type WriteAheadLog struct {
+	dir string
+	seq int64
+}
+
+type walSegment struct {
+	file   *os.File
+	writer *bufio.Writer
+	path   string
+}
+
+// WalSync waits until the points of a write request are synced to the wal of their backends,
+// and fails if any of them is not written to the wal
+type WalSync struct {
+	wg       sync.WaitGroup
+	backends map[*Backend]bool
+	failed   int32
+}
+
+func NewWalSync() *WalSync {
+	return &WalSync{backends: make(map[*Backend]bool)}
+}
+
+func (ws *WalSync) touch(be *Backend) {
+	if !ws.backends[be] {
+		ws.backends[be] = true
+		ws.wg.Add(1)
+	}
+}
+
+func (ws *WalSync) Wait() {
+	ws.wg.Wait()
+}
+
+func (ws *WalSync) fail() {
+	atomic.StoreInt32(&ws.failed, 1)
+}
+
+func (ws *WalSync) Failed() bool {
+	return atomic.LoadInt32(&ws.failed) == 1
+}
+
+func NewWriteAheadLog(name string, datadir string) (wal *WriteAheadLog, err error) {
+	wal = &WriteAheadLog{dir: filepath.Join(datadir, "wal", name)}
+	err = os.MkdirAll(wal.dir, 0755)
+	if err != nil {
+		return
+	}
+	segments, err := wal.segments()
+	if err != nil {
+		return
+	}
+	if len(segments) > 0 {
+		wal.seq, _, _ = parseSegmentName(segments[len(segments)-1])
+	}
+	return
+}
+
+// segments returns the names of segment files in the order they were created
+func (wal *WriteAheadLog) segments() (names []string, err error) {
+	files, err := ioutil.ReadDir(wal.dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range files {
+		if strings.HasSuffix(fi.Name(), ".wal") {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+func parseSegmentName(name string) (seq int64, db, rp string) {
+	parts := strings.SplitN(strings.TrimSuffix(name, ".wal"), "-", 2)
+	if len(parts) != 2 {
+		return
+	}
+	seq, _ = strconv.ParseInt(parts[0], 10, 64)
+	db, rp, _ = parseDbrpKey(parts[1])
+	return
+}
+
+// Create starts a segment for the buffer of key, which is encoded from db and rp
+func (wal *WriteAheadLog) Create(key string) (seg *walSegment, err error) {
+	wal.seq++
+	path := filepath.Join(wal.dir, fmt.Sprintf("%016d-%s.wal", wal.seq, key))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+	return &walSegment{file: file, writer: bufio.NewWriter(file), path: path}, nil
+}
+
+// Replay hands the data of the segments left by last run to fn, a segment is removed once fn succeeds
+func (wal *WriteAheadLog) Replay(fn func(db, rp string, p []byte) error) (count int, err error) {
+	names, err := wal.segments()
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		_, db, rp := parseSegmentName(name)
+		path := filepath.Join(wal.dir, name)
+		p, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Printf("read wal segment error: %s %s", path, err)
+			continue
+		}
+		if len(p) > 0 {
+			err = fn(db, rp, p)
+			if err != nil {
+				log.Printf("replay wal segment error: %s %s", path, err)
+				continue
+			}
+			count++
+		}
+		os.Remove(path)
+	}
+	return
+}
+
+func (seg *walSegment) Write(line []byte) (err error) {
+	_, err = seg.writer.Write(line)
+	if err == nil && line[len(line)-1] != '\n' {
+		err = seg.writer.WriteByte('\n')
+	}
+	return
+}
+
+func (seg *walSegment) Sync() (err error) {
+	err = seg.writer.Flush()
+	if err != nil {
+		return
+	}
+	return seg.file.Sync()
+}
+
+func (seg *walSegment) Close() (err error) {
+	err = seg.Sync()
+	if err != nil {
+		seg.file.Close()
+		return
+	}
+	return seg.file.Close()
+}
+
+func (seg *walSegment) Remove() {
+	err := os.Remove(seg.path)
+	if err != nil {
+		log.Printf("remove wal segment error: %s", err)
+	}
+}
@@ -0,0 +1,89 @@
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestWriteAheadLogReplay(t *testing.T) {
+	cfg := newTestProxyConfig(t)
+	wal, err := NewWriteAheadLog("b1", cfg.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg1, _ := wal.Create(dbrpKey("db1", ""))
+	seg1.Write([]byte("cpu value=1 1"))
+	seg1.Write([]byte("cpu value=2 2\n"))
+	seg1.Close()
+	seg2, _ := wal.Create(dbrpKey("db/2", "rp 2"))
+	seg2.Write([]byte("mem value=3 3\n"))
+	seg2.Sync()
+	seg3, _ := wal.Create(dbrpKey("db3", ""))
+	seg3.Close()
+	seg3.Remove()
+
+	// the segments are left as if the proxy crashed
+	wal, err = NewWriteAheadLog("b1", cfg.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wal.seq != 2 {
+		t.Errorf("seq: got %d, want 2", wal.seq)
+	}
+	var dbs, data []string
+	count, err := wal.Replay(func(db, rp string, p []byte) error {
+		dbs = append(dbs, db+":"+rp)
+		data = append(data, string(p))
+		return nil
+	})
+	if err != nil || count != 2 {
+		t.Fatalf("replay: got %d %v, want 2", count, err)
+	}
+	if dbs[0] != "db1:" || data[0] != "cpu value=1 1\ncpu value=2 2\n" || dbs[1] != "db/2:rp 2" || data[1] != "mem value=3 3\n" {
+		t.Errorf("replay: got %q %q", dbs, data)
+	}
+	files, _ := ioutil.ReadDir(wal.dir)
+	if len(files) != 0 {
+		t.Errorf("segments not removed after replay: %d", len(files))
+	}
+}
+
+func TestBackendWalReplay(t *testing.T) {
+	cfg := newTestProxyConfig(t)
+	cfg.WALEnabled = true
+	wal, err := NewWriteAheadLog("b1", cfg.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg, _ := wal.Create(dbrpKey("db", ""))
+	seg.Write([]byte("cpu value=1 1\n"))
+	seg.Close()
+
+	// the backend is unreachable, the replayed segment stays in the spool
+	be := NewBackend(&BackendConfig{Name: "b1", Url: "http://127.0.0.1:1"}, cfg)
+	defer be.Close()
+	if !be.fb.IsData() {
+		t.Error("wal segment not replayed into spool")
+	}
+	if _, err := os.Stat(seg.path); !os.IsNotExist(err) {
+		t.Errorf("wal segment not removed: %v", err)
+	}
+}
+
+func TestBackendWalFailed(t *testing.T) {
+	cfg := newTestProxyConfig(t)
+	cfg.WALEnabled = true
+	be := NewBackend(&BackendConfig{Name: "b1", Url: "http://127.0.0.1:1"}, cfg)
+	defer be.Close()
+	os.RemoveAll(be.wal.dir)
+
+	ws := NewWalSync()
+	ws.touch(be)
+	be.WritePoint(&LinePoint{Db: "db", Line: []byte("cpu value=1 1\n"), Sync: ws})
+	be.WritePoint(&LinePoint{Db: "db", Sync: ws})
+	ws.Wait()
+	if !ws.Failed() {
+		t.Error("wal sync not failed")
+	}
+}
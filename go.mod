@@ -3,12 +3,13 @@ module github.com/tixff/influx-proxy
 go 1.14
 
 require (
-	github.com/BurntSushi/toml v0.3.1 // indirect
 	github.com/influxdata/influxdb1-client v0.0.0-20200827194710-b269163b24ab
+	github.com/influxdata/influxql v1.1.0
 	github.com/json-iterator/go v1.1.10
 	github.com/klauspost/compress v1.11.3 // indirect
 	github.com/klauspost/pgzip v1.2.5
 	github.com/panjf2000/ants/v2 v2.4.3
+	github.com/prometheus/client_golang v1.9.0
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 	stathat.com/c/consistent v1.0.0
 )
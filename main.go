@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 
 	"github.com/tixff/influx-proxy/backend"
@@ -56,13 +59,17 @@ func main() {
 	}
 
 	mux := http.NewServeMux()
-	service.NewHttpService(cfg).Register(mux)
+	hs := service.NewHttpService(cfg)
+	hs.Register(mux)
+	go reload(hs)
 
 	server := &http.Server{
 		Addr:        cfg.ListenAddr,
 		Handler:     mux,
 		IdleTimeout: time.Duration(cfg.IdleTimeout) * time.Second,
 	}
+	closed := make(chan struct{})
+	go shutdown(server, hs, time.Duration(cfg.ShutdownTimeout)*time.Second, closed)
 	if cfg.HTTPSEnabled {
 		log.Printf("https service start, listen on %s", server.Addr)
 		err = server.ListenAndServeTLS(cfg.HTTPSCert, cfg.HTTPSKey)
@@ -70,8 +77,41 @@ func main() {
 		log.Printf("http service start, listen on %s", server.Addr)
 		err = server.ListenAndServe()
 	}
-	if err != nil {
+	if err != http.ErrServerClosed {
 		log.Print(err)
 		return
 	}
+	<-closed
+}
+
+func shutdown(server *http.Server, hs *service.HttpService, timeout time.Duration, closed chan struct{}) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-ch
+	log.Printf("%s received, shutdown with timeout %s", sig, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("http service shutdown error: %s", err)
+	}
+	// the drain has its own deadline, a slow shutdown of the requests does not eat its time
+	dctx, dcancel := context.WithTimeout(context.Background(), timeout)
+	defer dcancel()
+	hs.Close(dctx)
+	log.Print("shutdown done")
+	close(closed)
+}
+
+func reload(hs *service.HttpService) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		diff, err := hs.Reload()
+		if err != nil {
+			log.Printf("reload error: %s", err)
+			continue
+		}
+		log.Printf("reload config, applied: %v, refused: %v", diff.Applied, diff.Refused)
+	}
 }
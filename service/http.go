@@ -1,18 +1,23 @@
 package service
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
 	"net/http/pprof"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/influxdata/influxql"
 	gzip "github.com/klauspost/pgzip"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/tixff/influx-proxy/backend"
 	"github.com/tixff/influx-proxy/transfer"
 	"github.com/tixff/influx-proxy/util"
@@ -24,40 +29,98 @@ var (
 	ErrInvalidBatch   = errors.New("invalid batch, require positive integer")
 	ErrInvalidLimit   = errors.New("invalid limit, require positive integer")
 	ErrInvalidHaAddrs = errors.New("invalid ha_addrs, require at least two addresses as <host:port>, comma-separated")
+	ErrBodyTooLarge   = errors.New("request entity too large")
 )
 
+// maxBodyReader returns ErrBodyTooLarge once more than n bytes are read
+type maxBodyReader struct {
+	r io.Reader
+	n int64
+}
+
+func (mr *maxBodyReader) Read(p []byte) (n int, err error) {
+	if int64(len(p)) > mr.n+1 {
+		p = p[:mr.n+1]
+	}
+	n, err = mr.r.Read(p)
+	if int64(n) <= mr.n {
+		mr.n -= int64(n)
+		return
+	}
+	n = int(mr.n)
+	mr.n = 0
+	return n, ErrBodyTooLarge
+}
+
 type HttpService struct { // nolint:golint
-	ip           *backend.Proxy
-	tx           *transfer.Transfer
-	Username     string
-	Password     string
-	AuthEncrypt  bool
-	WriteTracing bool
-	QueryTracing bool
+	ip               *backend.Proxy
+	tx               *transfer.Transfer
+	Users            *backend.Users
+	WriteTracing     bool
+	QueryTracing     bool
+	WriteConsistency string
+	MaxBodySize      int
+	metrics          http.Handler
+	cfg              *backend.ProxyConfig
+	lock             sync.RWMutex
 }
 
 func NewHttpService(cfg *backend.ProxyConfig) (hs *HttpService) { // nolint:golint
 	ip := backend.NewProxy(cfg)
 	hs = &HttpService{
-		ip:           ip,
-		tx:           transfer.NewTransfer(cfg, ip.Circles),
-		Username:     cfg.Username,
-		Password:     cfg.Password,
-		AuthEncrypt:  cfg.AuthEncrypt,
-		WriteTracing: cfg.WriteTracing,
-		QueryTracing: cfg.QueryTracing,
+		ip:               ip,
+		tx:               transfer.NewTransfer(cfg, ip.Circles),
+		Users:            backend.NewUsers(cfg),
+		WriteTracing:     cfg.WriteTracing,
+		QueryTracing:     cfg.QueryTracing,
+		WriteConsistency: cfg.WriteConsistency,
+		MaxBodySize:      cfg.MaxBodySize,
+		metrics:          promhttp.Handler(),
+		cfg:              cfg,
 	}
 	return
 }
 
+// Reload re-reads the config file and applies its safe changes, the changes requiring a restart are refused
+func (hs *HttpService) Reload() (*backend.ConfigDiff, error) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	ncfg, err := hs.cfg.ReloadFile()
+	if err != nil {
+		return nil, err
+	}
+	cfg, diff := backend.MergeConfig(hs.cfg, ncfg)
+	if len(diff.Applied) == 0 {
+		return diff, nil
+	}
+	hs.ip.Reload(cfg)
+	hs.Users = backend.NewUsers(cfg)
+	hs.WriteTracing = cfg.WriteTracing
+	hs.QueryTracing = cfg.QueryTracing
+	hs.WriteConsistency = cfg.WriteConsistency
+	hs.MaxBodySize = cfg.MaxBodySize
+	hs.cfg = cfg
+	return diff, nil
+}
+
+// Close drains the backends, the points not written before ctx is done are spooled
+func (hs *HttpService) Close(ctx context.Context) {
+	hs.ip.Close(ctx)
+}
+
 func (hs *HttpService) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/ping", hs.HandlerPing)
 	mux.HandleFunc("/query", hs.HandlerQuery)
 	mux.HandleFunc("/write", hs.HandlerWrite)
 	mux.HandleFunc("/health", hs.HandlerHealth)
+	mux.HandleFunc("/reload", hs.HandlerReload)
+	mux.HandleFunc("/metrics", hs.HandlerMetrics)
 	mux.HandleFunc("/replica", hs.HandlerReplica)
 	mux.HandleFunc("/encrypt", hs.HandlerEncrypt)
 	mux.HandleFunc("/decrypt", hs.HandlerDencrypt)
+	mux.HandleFunc("/circle", hs.HandlerCircle)
+	mux.HandleFunc("/backend", hs.HandlerBackend)
+	mux.HandleFunc("/backlog", hs.HandlerBacklog)
 	mux.HandleFunc("/rebalance", hs.HandlerRebalance)
 	mux.HandleFunc("/recovery", hs.HandlerRecovery)
 	mux.HandleFunc("/resync", hs.HandlerResync)
@@ -75,27 +138,45 @@ func (hs *HttpService) HandlerPing(w http.ResponseWriter, req *http.Request) {
 
 func (hs *HttpService) HandlerQuery(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
-	if !hs.checkMethodAndAuth(w, req, "GET", "POST") {
+	if !hs.checkMethod(w, req, "GET", "POST") {
+		return
+	}
+	user := hs.checkAuth(w, req)
+	if user == nil {
 		return
 	}
 
 	db := req.FormValue("db")
 	q := req.FormValue("q")
-	body, err := hs.ip.Query(w, req)
+	body, err := hs.ip.Query(w, req, user)
 	if err != nil {
 		log.Printf("query error: %s, query: %s %s %s, client: %s", err, req.Method, db, q, req.RemoteAddr)
-		hs.WriteError(w, req, 400, err.Error())
+		if _, ok := err.(*backend.AuthorizationError); ok {
+			hs.WriteError(w, req, 403, err.Error())
+		} else {
+			hs.WriteError(w, req, 400, err.Error())
+		}
 		return
 	}
-	hs.WriteBody(w, body)
-	if hs.QueryTracing {
+	// the body is nil when the chunked response has been streamed
+	if body != nil {
+		hs.WriteBody(w, body)
+	}
+	hs.lock.RLock()
+	tracing := hs.QueryTracing
+	hs.lock.RUnlock()
+	if tracing {
 		log.Printf("query: %s %s %s, client: %s", req.Method, db, q, req.RemoteAddr)
 	}
 }
 
 func (hs *HttpService) HandlerWrite(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
-	if !hs.checkMethodAndAuth(w, req, "POST") {
+	if !hs.checkMethod(w, req, "POST") {
+		return
+	}
+	user := hs.checkAuth(w, req)
+	if user == nil {
 		return
 	}
 
@@ -108,12 +189,32 @@ func (hs *HttpService) HandlerWrite(w http.ResponseWriter, req *http.Request) {
 		hs.WriteError(w, req, 400, "database not found")
 		return
 	}
-	if len(hs.ip.DBSet) > 0 && !hs.ip.DBSet[db] {
+	if !hs.ip.AllowDB(db) {
 		hs.WriteError(w, req, 400, fmt.Sprintf("database forbidden: %s", db))
 		return
 	}
+	if err := user.AuthorizeDB(db, influxql.WritePrivilege); err != nil {
+		hs.WriteError(w, req, 403, err.Error())
+		return
+	}
+	rp := req.URL.Query().Get("rp")
+	hs.lock.RLock()
+	maxBodySize, tracing := hs.MaxBodySize, hs.WriteTracing
+	consistency := req.URL.Query().Get("consistency")
+	if consistency == "" {
+		consistency = hs.WriteConsistency
+	}
+	hs.lock.RUnlock()
+	if !backend.CheckConsistency(consistency) {
+		hs.WriteError(w, req, 400, "invalid consistency, require any, one, quorum or all")
+		return
+	}
 
-	body := req.Body
+	if maxBodySize > 0 && req.ContentLength > int64(maxBodySize) {
+		hs.WriteError(w, req, 413, ErrBodyTooLarge.Error())
+		return
+	}
+	var body io.Reader = req.Body
 	if req.Header.Get("Content-Encoding") == "gzip" {
 		b, err := gzip.NewReader(body)
 		if err != nil {
@@ -123,48 +224,113 @@ func (hs *HttpService) HandlerWrite(w http.ResponseWriter, req *http.Request) {
 		defer b.Close()
 		body = b
 	}
-	p, err := ioutil.ReadAll(body)
-	if err != nil {
-		hs.WriteError(w, req, 400, err.Error())
-		return
+	if maxBodySize > 0 {
+		body = &maxBodyReader{r: body, n: int64(maxBodySize)}
+	}
+	var trace *bytes.Buffer
+	if tracing {
+		trace = &bytes.Buffer{}
+		body = io.TeeReader(body, trace)
 	}
 
-	err = hs.ip.Write(p, db, precision)
-	if err == nil {
+	err := hs.ip.Write(body, db, rp, precision, consistency)
+	switch e := err.(type) {
+	case nil:
 		hs.WriteHeader(w, 204)
+	case *backend.WriteConsistencyError:
+		log.Printf("write error: %s, db: %s, client: %s", err, db, req.RemoteAddr)
+		hs.WriteErrorWithData(w, req, 500, err.Error(), e)
+	case *backend.PartialWriteError:
+		log.Printf("write error: %s, db: %s, client: %s", err, db, req.RemoteAddr)
+		hs.WriteError(w, req, 400, err.Error())
+	default:
+		if err == ErrBodyTooLarge {
+			log.Printf("write error: %s, db: %s, client: %s", err, db, req.RemoteAddr)
+			hs.WriteError(w, req, 413, err.Error())
+		} else if err == backend.ErrWalFailed {
+			log.Printf("write error: %s, db: %s, client: %s", err, db, req.RemoteAddr)
+			hs.WriteError(w, req, 500, err.Error())
+		} else {
+			hs.WriteError(w, req, 400, err.Error())
+		}
 	}
-	if hs.WriteTracing {
-		log.Printf("write: %s %s %s, client: %s", db, precision, p, req.RemoteAddr)
+	if tracing {
+		log.Printf("write: %s %s %s %s %s, client: %s", db, rp, precision, consistency, trace.Bytes(), req.RemoteAddr)
 	}
 }
 
 func (hs *HttpService) HandlerHealth(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
-	if !hs.checkMethodAndAuth(w, req, "GET") {
+	if !hs.checkMethodAndAdmin(w, req, "GET") {
 		return
 	}
 	stats := req.URL.Query().Get("stats") == "true"
 	hs.Write(w, req, 200, hs.ip.GetHealth(stats))
 }
 
-func (hs *HttpService) HandlerReplica(w http.ResponseWriter, req *http.Request) {
+func (hs *HttpService) HandlerReload(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if !hs.checkMethodAndAdmin(w, req, "POST") {
+		return
+	}
+	diff, err := hs.Reload()
+	if err != nil {
+		log.Printf("reload error: %s", err)
+		hs.WriteError(w, req, 400, fmt.Sprintf("illegal config file: %s", err))
+		return
+	}
+	log.Printf("reload config, applied: %v, refused: %v", diff.Applied, diff.Refused)
+	if len(diff.Refused) > 0 {
+		hs.WriteErrorWithData(w, req, 409, "config changes refused, restart required", diff)
+		return
+	}
+	hs.Write(w, req, 200, diff)
+}
+
+func (hs *HttpService) HandlerMetrics(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 	if !hs.checkMethodAndAuth(w, req, "GET") {
 		return
 	}
+	hs.metrics.ServeHTTP(w, req)
+}
+
+func (hs *HttpService) HandlerReplica(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if !hs.checkMethodAndAdmin(w, req, "GET") {
+		return
+	}
 
 	db := req.FormValue("db")
 	meas := req.FormValue("meas")
 	if db != "" && meas != "" {
-		key := backend.GetKey(db, meas)
-		backends := hs.ip.GetBackends(key)
-		data := make([]map[string]interface{}, len(backends))
-		for i, b := range backends {
-			c := hs.ip.Circles[i]
+		tags := make(map[string]string)
+		for _, tag := range hs.formValues(req, "tags") {
+			kv := strings.SplitN(tag, "=", 2)
+			if len(kv) != 2 {
+				hs.WriteError(w, req, 400, "invalid tags")
+				return
+			}
+			tags[kv[0]] = kv[1]
+		}
+		// all backends of a circle are candidates of a sharded measurement without the shard tag values
+		key, routed := hs.ip.ReplicaKey(db, meas, tags)
+		circles := hs.ip.GetCircles()
+		data := make([]map[string]interface{}, len(circles))
+		for i, c := range circles {
 			data[i] = map[string]interface{}{
-				"backend": map[string]string{"name": b.Name, "url": b.Url},
-				"circle":  map[string]interface{}{"id": c.CircleId, "name": c.Name},
+				"circle": map[string]interface{}{"id": c.CircleId, "name": c.Name},
 			}
+			if routed {
+				b := c.GetBackend(key)
+				data[i]["backend"] = map[string]string{"name": b.Name, "url": b.Url}
+				continue
+			}
+			backends := make([]map[string]string, len(c.Backends))
+			for j, b := range c.Backends {
+				backends[j] = map[string]string{"name": b.Name, "url": b.Url}
+			}
+			data[i]["backends"] = backends
 		}
 		hs.Write(w, req, 200, data)
 	} else {
@@ -197,9 +363,220 @@ func (hs *HttpService) HandlerDencrypt(w http.ResponseWriter, req *http.Request)
 	hs.WriteText(w, 200, decrypt)
 }
 
+func (hs *HttpService) HandlerCircle(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if !hs.checkMethodAndAdmin(w, req, "POST") {
+		return
+	}
+
+	operation := req.FormValue("operation")
+	if operation != "add" && operation != "rm" {
+		hs.WriteError(w, req, 400, "invalid operation")
+		return
+	}
+	force := false
+	if req.FormValue("force") != "" {
+		var err error
+		force, err = hs.formBool(req, "force")
+		if err != nil {
+			hs.WriteError(w, req, 400, "illegal force")
+			return
+		}
+	}
+	if !hs.checkTopologyIdle(w) {
+		return
+	}
+
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	var cfg *backend.ProxyConfig
+	if operation == "add" {
+		var circfg backend.CircleConfig
+		decoder := json.NewDecoder(req.Body)
+		err := decoder.Decode(&circfg)
+		if err != nil {
+			hs.WriteError(w, req, 400, "invalid circle from body")
+			return
+		}
+		cfg, err = hs.cfg.WithCircle(&circfg)
+		if err != nil {
+			hs.WriteError(w, req, 400, err.Error())
+			return
+		}
+		circle := hs.ip.AddCircle(&circfg, cfg)
+		hs.tx.AddCircleState(&circfg, circle)
+		log.Printf("circle %d added: %s", circle.CircleId, circle.Name)
+	} else {
+		circleId, err := hs.formCircleId(req, "circle_id") // nolint:golint
+		if err != nil {
+			hs.WriteError(w, req, 400, err.Error())
+			return
+		}
+		cfg, err = hs.cfg.WithoutCircle(circleId)
+		if err != nil {
+			hs.WriteError(w, req, 400, err.Error())
+			return
+		}
+		err = hs.ip.RemoveCircle(circleId, force)
+		if err != nil {
+			hs.WriteError(w, req, 400, err.Error())
+			return
+		}
+		hs.tx.RemoveCircleState(circleId)
+		log.Printf("circle %d removed: %s", circleId, hs.cfg.Circles[circleId].Name)
+	}
+	if hs.saveTopology(w, req, cfg) {
+		hs.Write(w, req, 200, hs.ip.GetHealth(false))
+	}
+}
+
+func (hs *HttpService) HandlerBackend(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if !hs.checkMethodAndAdmin(w, req, "POST") {
+		return
+	}
+
+	circleId, err := hs.formCircleId(req, "circle_id") // nolint:golint
+	if err != nil {
+		hs.WriteError(w, req, 400, err.Error())
+		return
+	}
+	operation := req.FormValue("operation")
+	if operation != "add" && operation != "rm" {
+		hs.WriteError(w, req, 400, "invalid operation")
+		return
+	}
+	rebalance, force := false, false
+	if req.FormValue("rebalance") != "" {
+		rebalance, err = hs.formBool(req, "rebalance")
+		if err != nil {
+			hs.WriteError(w, req, 400, "illegal rebalance")
+			return
+		}
+	}
+	if req.FormValue("force") != "" {
+		force, err = hs.formBool(req, "force")
+		if err != nil {
+			hs.WriteError(w, req, 400, "illegal force")
+			return
+		}
+	}
+	if !hs.checkTopologyIdle(w) {
+		return
+	}
+	if rebalance {
+		err = hs.setParam(req)
+		if err != nil {
+			hs.WriteError(w, req, 400, err.Error())
+			return
+		}
+	}
+
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	var cfg *backend.ProxyConfig
+	var backends []*backend.Backend
+	if operation == "add" {
+		var bkcfg backend.BackendConfig
+		decoder := json.NewDecoder(req.Body)
+		err = decoder.Decode(&bkcfg)
+		if err != nil {
+			hs.WriteError(w, req, 400, "invalid backend from body")
+			return
+		}
+		cfg, err = hs.cfg.WithBackend(circleId, &bkcfg)
+		if err != nil {
+			hs.WriteError(w, req, 400, err.Error())
+			return
+		}
+		hs.ip.AddBackend(circleId, &bkcfg, cfg)
+		hs.tx.AddStats(circleId, bkcfg.Url)
+		log.Printf("backend added to circle %d: %s %s", circleId, bkcfg.Name, bkcfg.Url)
+	} else {
+		name := req.FormValue("name")
+		var bkcfg *backend.BackendConfig
+		cfg, bkcfg, err = hs.cfg.WithoutBackend(circleId, name)
+		if err != nil {
+			hs.WriteError(w, req, 400, err.Error())
+			return
+		}
+		err = hs.ip.RemoveBackend(circleId, name, force)
+		if err != nil {
+			hs.WriteError(w, req, 400, err.Error())
+			return
+		}
+		// the removed backend is kept as a source of the rebalance
+		backends = append(backends, backend.NewSimpleBackend(bkcfg))
+		hs.tx.AddStats(circleId, bkcfg.Url)
+		log.Printf("backend removed from circle %d: %s %s", circleId, bkcfg.Name, bkcfg.Url)
+	}
+	if !hs.saveTopology(w, req, cfg) {
+		return
+	}
+	if !rebalance {
+		hs.Write(w, req, 200, hs.ip.GetHealth(false))
+		return
+	}
+
+	circles := hs.ip.GetCircles()
+	if circleId >= len(circles) {
+		hs.WriteError(w, req, 400, backend.ErrCircleNotFound.Error())
+		return
+	}
+	backends = append(backends, circles[circleId].Backends...)
+	dbs := hs.formValues(req, "dbs")
+	go hs.tx.Rebalance(circleId, backends, dbs)
+	hs.WriteText(w, 202, "accepted")
+}
+
+func (hs *HttpService) HandlerBacklog(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if !hs.checkMethodAndAdmin(w, req, "GET", "POST") {
+		return
+	}
+
+	if req.Method == "GET" {
+		hs.Write(w, req, 200, hs.ip.GetBacklog())
+		return
+	}
+	circleId, err := hs.formCircleId(req, "circle_id") // nolint:golint
+	if err != nil {
+		hs.WriteError(w, req, 400, err.Error())
+		return
+	}
+	be, err := hs.ip.FindBackend(circleId, req.FormValue("name"))
+	if err != nil {
+		hs.WriteError(w, req, 400, err.Error())
+		return
+	}
+	switch req.FormValue("operation") {
+	case "pause":
+		be.PauseRewrite()
+	case "resume":
+		be.ResumeRewrite()
+	case "rewrite":
+		if be.IsRewritePaused() {
+			hs.WriteError(w, req, 400, "rewrite is paused")
+			return
+		}
+		be.RewriteNow()
+	case "purge":
+		err = be.PurgeBacklog()
+		if err != nil {
+			hs.WriteError(w, req, 500, fmt.Sprintf("purge backlog error: %s", err))
+			return
+		}
+	default:
+		hs.WriteError(w, req, 400, "invalid operation")
+		return
+	}
+	log.Printf("backlog %s: circle %d, backend %s", req.FormValue("operation"), circleId, be.Name)
+	hs.Write(w, req, 200, be.GetBacklog())
+}
+
 func (hs *HttpService) HandlerRebalance(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
-	if !hs.checkMethodAndAuth(w, req, "POST") {
+	if !hs.checkMethodAndAdmin(w, req, "POST") {
 		return
 	}
 
@@ -227,12 +604,17 @@ func (hs *HttpService) HandlerRebalance(w http.ResponseWriter, req *http.Request
 		}
 		for _, bkcfg := range body.Backends {
 			backends = append(backends, backend.NewSimpleBackend(bkcfg))
-			hs.tx.CircleStates[circleId].Stats[bkcfg.Url] = &transfer.Stats{}
+			hs.tx.AddStats(circleId, bkcfg.Url)
 		}
 	}
-	backends = append(backends, hs.ip.Circles[circleId].Backends...)
+	circles := hs.ip.GetCircles()
+	if circleId >= len(circles) {
+		hs.WriteError(w, req, 400, backend.ErrCircleNotFound.Error())
+		return
+	}
+	backends = append(backends, circles[circleId].Backends...)
 
-	if hs.tx.CircleStates[circleId].Transferring {
+	if hs.tx.IsTransferring(circleId) {
 		hs.WriteText(w, 400, fmt.Sprintf("circle %d is transferring", circleId))
 		return
 	}
@@ -254,7 +636,7 @@ func (hs *HttpService) HandlerRebalance(w http.ResponseWriter, req *http.Request
 
 func (hs *HttpService) HandlerRecovery(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
-	if !hs.checkMethodAndAuth(w, req, "POST") {
+	if !hs.checkMethodAndAdmin(w, req, "POST") {
 		return
 	}
 
@@ -273,7 +655,7 @@ func (hs *HttpService) HandlerRecovery(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	if hs.tx.CircleStates[fromCircleId].Transferring || hs.tx.CircleStates[toCircleId].Transferring {
+	if hs.tx.IsTransferring(fromCircleId) || hs.tx.IsTransferring(toCircleId) {
 		hs.WriteText(w, 400, fmt.Sprintf("circle %d or %d is transferring", fromCircleId, toCircleId))
 		return
 	}
@@ -296,7 +678,7 @@ func (hs *HttpService) HandlerRecovery(w http.ResponseWriter, req *http.Request)
 
 func (hs *HttpService) HandlerResync(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
-	if !hs.checkMethodAndAuth(w, req, "POST") {
+	if !hs.checkMethodAndAdmin(w, req, "POST") {
 		return
 	}
 
@@ -306,8 +688,8 @@ func (hs *HttpService) HandlerResync(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	for _, cs := range hs.tx.CircleStates {
-		if cs.Transferring {
+	for k, cs := range hs.tx.CircleStates() {
+		if hs.tx.IsTransferring(k) {
 			hs.WriteText(w, 400, fmt.Sprintf("circle %d is transferring", cs.CircleId))
 			return
 		}
@@ -330,7 +712,7 @@ func (hs *HttpService) HandlerResync(w http.ResponseWriter, req *http.Request) {
 
 func (hs *HttpService) HandlerCleanup(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
-	if !hs.checkMethodAndAuth(w, req, "POST") {
+	if !hs.checkMethodAndAdmin(w, req, "POST") {
 		return
 	}
 
@@ -340,7 +722,7 @@ func (hs *HttpService) HandlerCleanup(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	if hs.tx.CircleStates[circleId].Transferring {
+	if hs.tx.IsTransferring(circleId) {
 		hs.WriteText(w, 400, fmt.Sprintf("circle %d is transferring", circleId))
 		return
 	}
@@ -361,17 +743,18 @@ func (hs *HttpService) HandlerCleanup(w http.ResponseWriter, req *http.Request)
 
 func (hs *HttpService) HandlerTransferState(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
-	if !hs.checkMethodAndAuth(w, req, "GET", "POST") {
+	if !hs.checkMethodAndAdmin(w, req, "GET", "POST") {
 		return
 	}
 
 	if req.Method == "GET" {
-		data := make([]map[string]interface{}, len(hs.tx.CircleStates))
-		for k, cs := range hs.tx.CircleStates {
+		states := hs.tx.CircleStates()
+		data := make([]map[string]interface{}, len(states))
+		for k, cs := range states {
 			data[k] = map[string]interface{}{
 				"id":           cs.CircleId,
 				"name":         cs.Name,
-				"transferring": cs.Transferring,
+				"transferring": hs.tx.IsTransferring(k),
 			}
 		}
 		state := map[string]interface{}{"resyncing": hs.tx.Resyncing, "circles": data}
@@ -399,13 +782,12 @@ func (hs *HttpService) HandlerTransferState(w http.ResponseWriter, req *http.Req
 				hs.WriteError(w, req, 400, "illegal transferring")
 				return
 			}
-			cs := hs.tx.CircleStates[circleId]
-			cs.Transferring = transferring
-			cs.WriteOnly = transferring
+			hs.tx.SetTransferring(circleId, transferring)
+			cs := hs.tx.CircleState(circleId)
 			state["circle"] = map[string]interface{}{
 				"id":           cs.CircleId,
 				"name":         cs.Name,
-				"transferring": cs.Transferring,
+				"transferring": transferring,
 			}
 		}
 		if len(state) == 0 {
@@ -419,7 +801,7 @@ func (hs *HttpService) HandlerTransferState(w http.ResponseWriter, req *http.Req
 
 func (hs *HttpService) HandlerTransferStats(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
-	if !hs.checkMethodAndAuth(w, req, "GET") {
+	if !hs.checkMethodAndAdmin(w, req, "GET") {
 		return
 	}
 
@@ -431,12 +813,39 @@ func (hs *HttpService) HandlerTransferStats(w http.ResponseWriter, req *http.Req
 
 	statsType := req.FormValue("type")
 	if statsType == "rebalance" || statsType == "recovery" || statsType == "resync" || statsType == "cleanup" {
-		hs.Write(w, req, 200, hs.tx.CircleStates[circleId].Stats)
+		hs.Write(w, req, 200, hs.tx.GetStats(circleId))
 	} else {
 		hs.WriteError(w, req, 400, "invalid stats type")
 	}
 }
 
+// checkTopologyIdle refuses a topology change when a transfer or resync is running
+func (hs *HttpService) checkTopologyIdle(w http.ResponseWriter) bool {
+	for k, cs := range hs.tx.CircleStates() {
+		if hs.tx.IsTransferring(k) {
+			hs.WriteText(w, 400, fmt.Sprintf("circle %d is transferring", cs.CircleId))
+			return false
+		}
+	}
+	if hs.tx.Resyncing {
+		hs.WriteText(w, 400, "proxy is resyncing")
+		return false
+	}
+	return true
+}
+
+// saveTopology keeps cfg as the live config and persists it
+func (hs *HttpService) saveTopology(w http.ResponseWriter, req *http.Request, cfg *backend.ProxyConfig) bool {
+	hs.cfg = cfg
+	err := cfg.SaveFile()
+	if err != nil {
+		log.Printf("save config file error: %s", err)
+		hs.WriteError(w, req, 500, fmt.Sprintf("topology changed but config file not saved: %s", err))
+		return false
+	}
+	return true
+}
+
 func (hs *HttpService) Write(w http.ResponseWriter, req *http.Request, status int, data interface{}) {
 	if status >= 400 {
 		hs.WriteError(w, req, status, data.(string))
@@ -457,6 +866,18 @@ func (hs *HttpService) WriteError(w http.ResponseWriter, req *http.Request, stat
 	w.Write(util.MarshalJSON(rsp, pretty))
 }
 
+func (hs *HttpService) WriteErrorWithData(w http.ResponseWriter, req *http.Request, status int, err string, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Influxdb-Error", err)
+	hs.WriteHeader(w, status)
+	rsp := struct {
+		Err  string      `json:"error"`
+		Data interface{} `json:"data"`
+	}{err, data}
+	pretty := req.URL.Query().Get("pretty") == "true"
+	w.Write(util.MarshalJSON(rsp, pretty))
+}
+
 func (hs *HttpService) WriteBody(w http.ResponseWriter, body []byte) {
 	hs.WriteHeader(w, 200)
 	w.Write(body)
@@ -473,7 +894,22 @@ func (hs *HttpService) WriteHeader(w http.ResponseWriter, status int) {
 }
 
 func (hs *HttpService) checkMethodAndAuth(w http.ResponseWriter, req *http.Request, methods ...string) bool {
-	return hs.checkMethod(w, req, methods...) && hs.checkAuth(w, req)
+	return hs.checkMethod(w, req, methods...) && hs.checkAuth(w, req) != nil
+}
+
+func (hs *HttpService) checkMethodAndAdmin(w http.ResponseWriter, req *http.Request, methods ...string) bool {
+	if !hs.checkMethod(w, req, methods...) {
+		return false
+	}
+	user := hs.checkAuth(w, req)
+	if user == nil {
+		return false
+	}
+	if err := user.AuthorizeAdmin(); err != nil {
+		hs.WriteError(w, req, 403, err.Error())
+		return false
+	}
+	return true
 }
 
 func (hs *HttpService) checkMethod(w http.ResponseWriter, req *http.Request, methods ...string) bool {
@@ -486,27 +922,21 @@ func (hs *HttpService) checkMethod(w http.ResponseWriter, req *http.Request, met
 	return false
 }
 
-func (hs *HttpService) checkAuth(w http.ResponseWriter, req *http.Request) bool {
-	if hs.Username == "" && hs.Password == "" {
-		return true
-	}
-	u, p := req.URL.Query().Get("u"), req.URL.Query().Get("p")
-	if hs.transAuth(u) == hs.Username && hs.transAuth(p) == hs.Password {
-		return true
-	}
-	u, p, ok := req.BasicAuth()
-	if ok && hs.transAuth(u) == hs.Username && hs.transAuth(p) == hs.Password {
-		return true
+// checkAuth returns the user authenticated by the u and p query parameters or the basic auth, or nil if authentication fails
+func (hs *HttpService) checkAuth(w http.ResponseWriter, req *http.Request) *backend.User {
+	hs.lock.RLock()
+	users := hs.Users
+	hs.lock.RUnlock()
+	if user := users.Authenticate(req.URL.Query().Get("u"), req.URL.Query().Get("p")); user != nil {
+		return user
+	}
+	if u, p, ok := req.BasicAuth(); ok {
+		if user := users.Authenticate(u, p); user != nil {
+			return user
+		}
 	}
 	hs.WriteError(w, req, 401, "authentication failed")
-	return false
-}
-
-func (hs *HttpService) transAuth(text string) string {
-	if hs.AuthEncrypt {
-		return util.AesEncrypt(text)
-	}
-	return text
+	return nil
 }
 
 func (hs *HttpService) formValues(req *http.Request, key string) []string {
@@ -536,7 +966,7 @@ func (hs *HttpService) formTick(req *http.Request) (int64, error) {
 
 func (hs *HttpService) formCircleId(req *http.Request, key string) (int, error) { // nolint:golint
 	circleId, err := strconv.Atoi(req.FormValue(key)) // nolint:golint
-	if err != nil || circleId < 0 || circleId >= len(hs.ip.Circles) {
+	if err != nil || circleId < 0 || circleId >= len(hs.ip.GetCircles()) {
 		return circleId, fmt.Errorf("invalid %s", key)
 	}
 	return circleId, nil
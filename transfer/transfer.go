@@ -42,7 +42,8 @@ type Transfer struct {
 
 	pool         *ants.Pool
 	tlogDir      string
-	CircleStates []*CircleState
+	lock         sync.RWMutex
+	circleStates []*CircleState
 	Worker       int
 	Batch        int
 	Limit        int
@@ -53,19 +54,84 @@ type Transfer struct {
 func NewTransfer(cfg *backend.ProxyConfig, circles []*backend.Circle) (tx *Transfer) {
 	tx = &Transfer{
 		tlogDir:      cfg.TLogDir,
-		CircleStates: make([]*CircleState, len(cfg.Circles)),
+		circleStates: make([]*CircleState, len(cfg.Circles)),
 		Worker:       DefaultWorker,
 		Batch:        DefaultBatch,
 		Limit:        DefaultLimit,
 	}
 	for idx, circfg := range cfg.Circles {
-		tx.CircleStates[idx] = NewCircleState(circfg, circles[idx])
+		tx.circleStates[idx] = NewCircleState(circfg, circles[idx])
 	}
 	return
 }
 
+func (tx *Transfer) AddCircleState(cfg *backend.CircleConfig, circle *backend.Circle) {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	tx.circleStates = append(tx.circleStates, NewCircleState(cfg, circle))
+}
+
+func (tx *Transfer) RemoveCircleState(circleId int) { // nolint:golint
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	tx.circleStates = append(tx.circleStates[:circleId:circleId], tx.circleStates[circleId+1:]...)
+}
+
+func (tx *Transfer) CircleState(circleId int) *CircleState { // nolint:golint
+	tx.lock.RLock()
+	defer tx.lock.RUnlock()
+	return tx.circleStates[circleId]
+}
+
+// CircleStates returns a copy of the circle states
+func (tx *Transfer) CircleStates() []*CircleState {
+	tx.lock.RLock()
+	defer tx.lock.RUnlock()
+	return append([]*CircleState(nil), tx.circleStates...)
+}
+
+func (tx *Transfer) IsTransferring(circleId int) bool { // nolint:golint
+	tx.lock.RLock()
+	defer tx.lock.RUnlock()
+	return tx.circleStates[circleId].Transferring
+}
+
+func (tx *Transfer) SetTransferring(circleId int, transferring bool) { // nolint:golint
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	cs := tx.circleStates[circleId]
+	cs.Transferring = transferring
+	cs.WriteOnly = transferring
+}
+
+// AddStats adds empty stats of the backend url to the circle, for a backend being removed from the circle
+func (tx *Transfer) AddStats(circleId int, url string) { // nolint:golint
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	tx.circleStates[circleId].Stats[url] = &Stats{}
+}
+
+// GetStats returns a copy of the stats of the circle
+func (tx *Transfer) GetStats(circleId int) map[string]*Stats { // nolint:golint
+	tx.lock.RLock()
+	defer tx.lock.RUnlock()
+	stats := make(map[string]*Stats, len(tx.circleStates[circleId].Stats))
+	for url, s := range tx.circleStates[circleId].Stats {
+		stats[url] = s
+	}
+	return stats
+}
+
+func (tx *Transfer) getStats(cs *CircleState, url string) *Stats {
+	tx.lock.RLock()
+	defer tx.lock.RUnlock()
+	return cs.Stats[url]
+}
+
 func (tx *Transfer) resetCircleStates() {
-	for _, cs := range tx.CircleStates {
+	tx.lock.RLock()
+	defer tx.lock.RUnlock()
+	for _, cs := range tx.circleStates {
 		cs.ResetStates()
 	}
 }
@@ -92,7 +158,7 @@ func (tx *Transfer) setLogOutput(name string) {
 }
 
 func (tx *Transfer) getDatabases() []string {
-	for _, cs := range tx.CircleStates {
+	for _, cs := range tx.CircleStates() {
 		for _, be := range cs.Backends {
 			if be.IsActive() {
 				dbs := be.GetDatabases()
@@ -111,7 +177,7 @@ func (tx *Transfer) createDatabases(dbs []string) ([]string, error) {
 	}
 	if len(dbs) > 0 {
 		backends := make([]*backend.Backend, 0)
-		for _, cs := range tx.CircleStates {
+		for _, cs := range tx.CircleStates() {
 			backends = append(backends, cs.Backends...)
 		}
 		for _, db := range dbs {
@@ -325,7 +391,7 @@ func (tx *Transfer) runTransfer(cs *CircleState, be *backend.Backend, dbs []stri
 		return
 	}
 
-	stats := cs.Stats[be.Url]
+	stats := tx.getStats(cs, be.Url)
 	stats.DatabaseTotal = int32(len(dbs))
 	measures := make([][]string, len(dbs))
 	var wg sync.WaitGroup
@@ -343,6 +409,13 @@ func (tx *Transfer) runTransfer(cs *CircleState, be *backend.Backend, dbs []stri
 
 	for i, db := range dbs {
 		for _, meas := range measures[i] {
+			if cs.ShardTags.IsSharded(db, meas) {
+				// points of a sharded measurement are spread by tags and stay where they are
+				tlog.Printf("backend:%s db:%s meas:%s sharded by tags, skipped", be.Url, db, meas)
+				atomic.AddInt32(&stats.InPlaceCount, 1)
+				atomic.AddInt32(&stats.MeasurementDone, 1)
+				continue
+			}
 			require := fn(cs, be, db, meas, args)
 			if require {
 				atomic.AddInt32(&stats.TransferCount, 1)
@@ -368,7 +441,7 @@ func (tx *Transfer) Rebalance(circleId int, backends []*backend.Backend, dbs []s
 	}
 	defer tx.pool.Release()
 	tlog.Printf("rebalance start: circle %d", circleId)
-	cs := tx.CircleStates[circleId]
+	cs := tx.CircleState(circleId)
 	tx.resetCircleStates()
 	tx.broadcastTransferring(cs, true)
 	defer tx.broadcastTransferring(cs, false)
@@ -405,8 +478,8 @@ func (tx *Transfer) Recovery(fromCircleId, toCircleId int, backendUrls []string,
 	}
 	defer tx.pool.Release()
 	tlog.Printf("recovery start: circle from %d to %d", fromCircleId, toCircleId)
-	fcs := tx.CircleStates[fromCircleId]
-	tcs := tx.CircleStates[toCircleId]
+	fcs := tx.CircleState(fromCircleId)
+	tcs := tx.CircleState(toCircleId)
 	tx.resetCircleStates()
 	tx.broadcastTransferring(tcs, true)
 	defer tx.broadcastTransferring(tcs, false)
@@ -459,7 +532,7 @@ func (tx *Transfer) Resync(dbs []string, tick int64) {
 	tx.broadcastResyncing(true)
 	defer tx.broadcastResyncing(false)
 
-	for _, cs := range tx.CircleStates {
+	for _, cs := range tx.CircleStates() {
 		tlog.Printf("resync start: circle %d", cs.CircleId)
 		for _, be := range cs.Backends {
 			cs.wg.Add(1)
@@ -476,7 +549,7 @@ func (tx *Transfer) runResync(cs *CircleState, be *backend.Backend, db string, m
 	tick := args[0].(int64)
 	key := backend.GetKey(db, meas)
 	dsts := make([]*backend.Backend, 0)
-	for _, tcs := range tx.CircleStates {
+	for _, tcs := range tx.CircleStates() {
 		if tcs.CircleId != cs.CircleId {
 			dst := tcs.GetBackend(key)
 			dsts = append(dsts, dst)
@@ -499,7 +572,7 @@ func (tx *Transfer) Cleanup(circleId int) { // nolint:golint
 	}
 	defer tx.pool.Release()
 	tlog.Printf("cleanup start: circle %d", circleId)
-	cs := tx.CircleStates[circleId]
+	cs := tx.CircleState(circleId)
 	tx.resetCircleStates()
 	tx.broadcastTransferring(cs, true)
 	defer tx.broadcastTransferring(cs, false)
@@ -539,8 +612,10 @@ func (tx *Transfer) broadcastResyncing(resyncing bool) {
 }
 
 func (tx *Transfer) broadcastTransferring(cs *CircleState, transferring bool) {
+	tx.lock.Lock()
 	cs.Transferring = transferring
 	cs.WriteOnly = transferring
+	tx.lock.Unlock()
 	client := backend.NewClient(tx.httpsEnabled, 10)
 	for _, addr := range tx.HaAddrs {
 		url := fmt.Sprintf("http://%s/transfer/state?circle_id=%d&transferring=%t", addr, cs.CircleId, transferring)